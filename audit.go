@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+)
+
+var auditPath = flag.String("audit", "", "append every applied table change to this file")
+
+// audit reasons of the parent's own changes, the resolver sends its own
+const reasonExit = "exit"
+
+// auditRecord is a line of the audit log, Op is the event: "add", "delete"
+// or "flush"
+type auditRecord struct {
+	Time   time.Time
+	Op     string
+	Table  string
+	IP     string
+	Host   string
+	Server string
+	TTL    int64
+	Reason string
+}
+
+// the audit log, opened append only before we're sandboxed
+var audit struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAudit() error {
+	if len(*auditPath) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(*auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	audit.mu.Lock()
+	old := audit.f
+	audit.f = f
+	audit.mu.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// reopenAudit after the log was rotated
+func reopenAudit() {
+	if err := openAudit(); err != nil {
+		slog.Error("can't reopen audit log", "path", *auditPath, "err", err)
+	}
+}
+
+// auditLog records changes the backend applied, one line per ip. a flush
+// has no ips, its why is whys[""]
+func auditLog(op string, table string, ips []string, whys map[string]backend.Why) {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	if audit.f == nil {
+		return
+	}
+
+	now := time.Now()
+	if len(ips) == 0 {
+		// flush
+		ips = []string{""}
+	}
+
+	var buf []byte
+	for _, ip := range ips {
+		w := whys[ip]
+		r := auditRecord{
+			Time:   now,
+			Op:     op,
+			Table:  table,
+			IP:     ip,
+			Host:   w.Host,
+			Server: w.Server,
+			TTL:    w.TTL,
+			Reason: w.Reason,
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	// a single write, lines don't interleave with another pfdns
+	if _, err := audit.f.Write(buf); err != nil {
+		slog.Error("audit log", "path", *auditPath, "err", err)
+	}
+}
+
+// auditQuery is the audit subcommand, prints the records matching args
+func auditQuery(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	path := fs.String("file", *auditPath, "audit log")
+	ip := fs.String("ip", "", "ip, or cidr")
+	table := fs.String("table", "", "table")
+	host := fs.String("host", "", "host")
+	reason := fs.String("reason", "", "reason")
+	since := fs.String("since", "", "records since, a duration ago (24h) or a RFC3339 time")
+	asJSON := fs.Bool("json", false, "print records as json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if len(*path) == 0 {
+		fmt.Fprintln(os.Stderr, "audit: no audit log, use -audit or -file")
+		return 2
+	}
+
+	var cidr *net.IPNet
+	var err error
+	if strings.Contains(*ip, "/") {
+		_, cidr, err = net.ParseCIDR(*ip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit: -ip: %s\n", err)
+			return 2
+		}
+	}
+
+	var after time.Time
+	if len(*since) > 0 {
+		after, err = parseSince(*since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit: -since: %s\n", err)
+			return 2
+		}
+	}
+
+	f, err := os.Open(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit: %s\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			fmt.Fprintf(os.Stderr, "audit: bad record %q: %s\n", s.Text(), err)
+			continue
+		}
+
+		switch {
+		case r.Time.Before(after):
+			continue
+		case len(*table) > 0 && r.Table != *table:
+			continue
+		case len(*host) > 0 && r.Host != *host:
+			continue
+		case len(*reason) > 0 && r.Reason != *reason:
+			continue
+		case len(*ip) > 0 && !auditMatchIP(r, *ip, cidr):
+			continue
+		}
+
+		if *asJSON {
+			fmt.Println(s.Text())
+			continue
+		}
+		fmt.Printf("%s %-6s %s %s reason=%s host=%s server=%s ttl=%d\n",
+			r.Time.Format(time.RFC3339), r.Op, r.Table, r.IP, r.Reason, r.Host, r.Server, r.TTL)
+	}
+	if err := s.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "audit: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// a flush matches every ip in its table
+func auditMatchIP(r auditRecord, ip string, n *net.IPNet) bool {
+	if r.Op == "flush" {
+		return true
+	}
+	if n != nil {
+		parsed := net.ParseIP(r.IP)
+		return parsed != nil && n.Contains(parsed)
+	}
+	return r.IP == ip
+}
+
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
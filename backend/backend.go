@@ -0,0 +1,27 @@
+// Package backend applies the resolver's table changes to a firewall
+package backend
+
+// the parts of an update, in the order they are applied. they are also the
+// hook and audit log events
+const (
+	OpFlush  = "flush"
+	OpDelete = "delete"
+	OpAdd    = "add"
+)
+
+// Backend is a firewall's address tables
+type Backend interface {
+	// Flush removes every ip from table
+	Flush(table string) error
+	// Add adds ips to table, ips already in it are fine
+	Add(table string, ips []string) error
+	// Delete removes ips from table, ips not in it are fine
+	Delete(table string, ips []string) error
+}
+
+// Committer is a Backend that collects an update's changes and applies them
+// together on Commit
+type Committer interface {
+	Backend
+	Commit(table string) error
+}
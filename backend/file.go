@@ -0,0 +1,185 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long the reload command may run, table updates wait for it
+const reloadTimeout = 10 * time.Second
+
+// File formats
+const (
+	// an ip per line with a comment on top, for pfctl -T replace -f
+	FormatPF = "pf"
+	// an ip per line, for squid acls, haproxy acl files and the like
+	FormatList = "list"
+	// {"Table": "name", "IPs": ["ip"...]}
+	FormatJSON = "json"
+)
+
+// File keeps each table in a file, for tools that read address lists. a
+// table is written to a temporary file renamed over the old one, so readers
+// see all of an update or nothing of it
+type File struct {
+	// where a table goes, every %s in the file name is replaced by the table
+	// name and nothing else in it is special
+	path   string
+	format string
+	// run after a table was written, %s in its arguments is the table name
+	reload []string
+
+	mu     sync.Mutex
+	tables map[string]map[string]bool
+}
+
+// a table in FormatJSON
+type fileTable struct {
+	Table string
+	IPs   []string
+}
+
+// NewFile writes tables to path in format, running reload after each write.
+// path needs %s in its file name, each %s is replaced by the table name, any
+// other % is kept as is
+func NewFile(path string, format string, reload []string) (*File, error) {
+	if !strings.Contains(filepath.Base(path), "%s") || strings.Contains(filepath.Dir(path), "%s") {
+		return nil, fmt.Errorf("file path %q needs %%s in the file name", path)
+	}
+	switch format {
+	case FormatPF, FormatList, FormatJSON:
+	default:
+		return nil, fmt.Errorf("bad file format %q", format)
+	}
+
+	return &File{
+		path:   path,
+		format: format,
+		reload: reload,
+		tables: make(map[string]map[string]bool),
+	}, nil
+}
+
+// Dir the tables are written to
+func (f *File) Dir() string {
+	return filepath.Dir(f.path)
+}
+
+// Flush empties table, its file is written on Commit
+func (f *File) Flush(table string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tables[table] = make(map[string]bool)
+	return nil
+}
+
+// Add adds ips to table, its file is written on Commit
+func (f *File) Add(table string, ips []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	set, ok := f.tables[table]
+	if !ok {
+		set = make(map[string]bool)
+		f.tables[table] = set
+	}
+	for _, ip := range ips {
+		set[ip] = true
+	}
+	return nil
+}
+
+// Delete removes ips from table, its file is written on Commit
+func (f *File) Delete(table string, ips []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, ip := range ips {
+		delete(f.tables[table], ip)
+	}
+	return nil
+}
+
+// Commit writes table's file through a temporary file renamed over it, then
+// runs the reload command
+func (f *File) Commit(table string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// table names come from the config, keep them in the directory
+	if len(table) == 0 || strings.ContainsRune(table, '/') || strings.HasPrefix(table, ".") {
+		return fmt.Errorf("can't write table %q to a file", table)
+	}
+
+	ips := make([]string, 0, len(f.tables[table]))
+	for ip := range f.tables[table] {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	path := strings.ReplaceAll(f.path, "%s", table)
+
+	var buf bytes.Buffer
+	switch f.format {
+	case FormatPF:
+		fmt.Fprintf(&buf, "# table <%s>, written by pfdns\n", table)
+		fallthrough
+	case FormatList:
+		for _, ip := range ips {
+			buf.WriteString(ip)
+			buf.WriteByte('\n')
+		}
+	case FormatJSON:
+		blob, err := json.MarshalIndent(fileTable{Table: table, IPs: ips}, "", "\t")
+		if err != nil {
+			return err
+		}
+		buf.Write(append(blob, '\n'))
+	}
+
+	// we're the only writer, a fixed temporary name will do
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write table %s: %s", table, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write table %s: %s", table, err)
+	}
+
+	slog.Debug("wrote table", "table", table, "path", path, "ips", len(ips))
+
+	if len(f.reload) == 0 {
+		return nil
+	}
+
+	args := make([]string, len(f.reload))
+	for n, a := range f.reload {
+		args[n] = strings.ReplaceAll(a, "%s", table)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// don't wait for children holding on to its output after a kill
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = bytes.TrimSpace(out)
+		slog.Error("reload command", "table", table, "args", args, "err", err, "out", string(out))
+		return fmt.Errorf("reload command: %s: %s", err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatPF, "# table <t>, written by pfdns\n192.0.2.1\n192.0.2.3\n"},
+		{FormatList, "192.0.2.1\n192.0.2.3\n"},
+		{FormatJSON, "{\n\t\"Table\": \"t\",\n\t\"IPs\": [\n\t\t\"192.0.2.1\",\n\t\t\"192.0.2.3\"\n\t]\n}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := NewFile(filepath.Join(dir, "%s.txt"), tt.format, nil)
+			if err != nil {
+				t.Fatalf("new: %s", err)
+			}
+
+			_ = f.Flush("t")
+			_ = f.Add("t", []string{"192.0.2.3", "192.0.2.2", "192.0.2.1"})
+			_ = f.Delete("t", []string{"192.0.2.2", "192.0.2.9"})
+			if err := f.Commit("t"); err != nil {
+				t.Fatalf("commit: %s", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "t.txt"))
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+
+			if tt.format == FormatJSON {
+				var ft fileTable
+				if err := json.Unmarshal(got, &ft); err != nil || ft.Table != "t" || len(ft.IPs) != 2 {
+					t.Errorf("json %+v, err %v", ft, err)
+				}
+			}
+		})
+	}
+}
+
+// the file is replaced by a rename, a reader holding the old one keeps it
+// whole and no temporary file is left behind
+func TestFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(filepath.Join(dir, "%s"), FormatList, nil)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+
+	_ = f.Add("t", []string{"192.0.2.1"})
+	if err := f.Commit("t"); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	old, err := os.Open(filepath.Join(dir, "t"))
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer old.Close()
+
+	_ = f.Flush("t")
+	_ = f.Add("t", []string{"192.0.2.2"})
+	if err := f.Commit("t"); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	buf := make([]byte, 100)
+	n, _ := old.Read(buf)
+	if got := string(buf[:n]); got != "192.0.2.1\n" {
+		t.Errorf("old file has %q", got)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "t"))
+	if string(got) != "192.0.2.2\n" {
+		t.Errorf("new file has %q", got)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("dir has %d files, want only t", len(entries))
+	}
+}
+
+// only %s is the table name, other % signs are part of the path
+func TestFilePath(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(filepath.Join(dir, "100%_%s_%d.txt"), FormatList, nil)
+	if err != nil {
+		t.Fatalf("new: %s", err)
+	}
+	if err := f.Commit("t"); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "100%_t_%d.txt")); err != nil {
+		t.Errorf("table not at its path: %s", err)
+	}
+
+	if _, err := NewFile(filepath.Join(dir, "tables"), FormatList, nil); err == nil {
+		t.Errorf("path without %%s accepted")
+	}
+	if _, err := NewFile(filepath.Join(dir, "%s", "t"), FormatList, nil); err == nil {
+		t.Errorf("%%s in the directory accepted")
+	}
+	if err := f.Commit("../t"); err == nil {
+		t.Errorf("table out of the directory written")
+	}
+}
@@ -0,0 +1,47 @@
+package backend
+
+// Multi applies changes to several backends in order, a change fails if it
+// failed on any of them
+type Multi []Backend
+
+// Flush flushes table on each backend
+func (m Multi) Flush(table string) error {
+	for _, b := range m {
+		if err := b.Flush(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add adds ips to table on each backend
+func (m Multi) Add(table string, ips []string) error {
+	for _, b := range m {
+		if err := b.Add(table, ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes ips from table on each backend
+func (m Multi) Delete(table string, ips []string) error {
+	for _, b := range m {
+		if err := b.Delete(table, ips); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits table on each backend that is a Committer
+func (m Multi) Commit(table string) error {
+	for _, b := range m {
+		if c, ok := b.(Committer); ok {
+			if err := c.Commit(table); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
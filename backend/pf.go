@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os/exec"
+)
+
+// PF drives pf's tables with pfctl
+type PF struct {
+	// log, but don't run pfctl
+	Dry bool
+}
+
+// Flush flushes table with pfctl -T flush
+func (p PF) Flush(table string) error {
+	slog.Info("flushing table", "table", table)
+
+	if p.Dry {
+		return nil
+	}
+
+	return pfctl("-q", "-t", table, "-T", "flush")
+}
+
+// Add adds ips to table with pfctl -T add
+func (p PF) Add(table string, ips []string) error {
+	if len(ips) == 0 || p.Dry {
+		return nil
+	}
+
+	cargs := []string{"-t", table, "-T", "add"}
+	cargs = append(cargs, ips...)
+
+	return pfctl(cargs...)
+}
+
+// Delete removes ips from table with pfctl -T delete
+func (p PF) Delete(table string, ips []string) error {
+	if len(ips) == 0 || p.Dry {
+		return nil
+	}
+
+	cargs := []string{"-t", table, "-T", "delete"}
+	cargs = append(cargs, ips...)
+
+	return pfctl(cargs...)
+}
+
+func pfctl(cargs ...string) error {
+	_, err := Pfctl(cargs...)
+	return err
+}
+
+// Pfctl runs pfctl and returns what it printed
+func Pfctl(cargs ...string) ([]byte, error) {
+	cmd := exec.Command("/sbin/pfctl", cargs...)
+	out, err := cmd.CombinedOutput()
+	out = bytes.TrimSpace(out)
+	if err != nil {
+		slog.Error("pfctl", "args", cargs, "err", err, "out", string(out))
+
+		if len(out) == 0 {
+			return nil, fmt.Errorf("pfctl: %s", err)
+		}
+		return nil, fmt.Errorf("pfctl: %s: %s", err, out)
+	}
+	return out, nil
+}
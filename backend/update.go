@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Why a change was made, as sent by the resolver
+type Why struct {
+	Reason string
+	Host   string
+	Server string
+	TTL    int64
+}
+
+// ParseChange splits a change from an updateTable request: "flush", "+ip"
+// or "-ip", optionally followed by tab separated reason, host, server and ttl
+func ParseChange(a string) (string, Why) {
+	f := strings.Split(a, "\t")
+
+	var w Why
+	if len(f) == 5 {
+		w.Reason, w.Host, w.Server = f[1], f[2], f[3]
+		w.TTL, _ = strconv.ParseInt(f[4], 10, 64)
+	}
+	return f[0], w
+}
+
+// Update is a batch of changes to a table
+type Update struct {
+	Table string
+	Flush bool
+	Add   []string
+	Del   []string
+
+	// why each ip is in the update, the flush's is Why[""]
+	Why map[string]Why
+}
+
+// ParseUpdate parses an updateTable request: the table name followed by
+// changes, see ParseChange
+func ParseUpdate(argv []string) (Update, error) {
+	if len(argv) < 1 {
+		return Update{}, fmt.Errorf("updateTable: no table")
+	}
+
+	u := Update{Table: argv[0], Why: make(map[string]Why)}
+	for _, a := range argv[1:] {
+		change, why := ParseChange(a)
+		switch {
+		case change == "flush":
+			u.Flush = true
+			u.Why[""] = why
+		case strings.HasPrefix(change, "+"):
+			u.Add = append(u.Add, change[1:])
+			u.Why[change[1:]] = why
+		case strings.HasPrefix(change, "-"):
+			u.Del = append(u.Del, change[1:])
+			u.Why[change[1:]] = why
+		default:
+			return Update{}, fmt.Errorf("updateTable %s: bad change %q", u.Table, a)
+		}
+	}
+	return u, nil
+}
+
+// Apply flushes, deletes and adds to b, and commits them if b is a
+// Committer. done is then called with each part b applied, OpFlush without
+// ips
+func (u Update) Apply(b Backend, done func(op string, ips []string)) error {
+	type part struct {
+		op  string
+		ips []string
+	}
+	var parts []part
+
+	if u.Flush {
+		if err := b.Flush(u.Table); err != nil {
+			return err
+		}
+		parts = append(parts, part{OpFlush, nil})
+	}
+
+	// try both, so a bad delete doesn't hold up the adds
+	var delErr, addErr error
+	if len(u.Del) > 0 {
+		if delErr = b.Delete(u.Table, u.Del); delErr == nil {
+			parts = append(parts, part{OpDelete, u.Del})
+		}
+	}
+	if len(u.Add) > 0 {
+		if addErr = b.Add(u.Table, u.Add); addErr == nil {
+			parts = append(parts, part{OpAdd, u.Add})
+		}
+	}
+
+	if c, ok := b.(Committer); ok && len(parts) > 0 {
+		if err := c.Commit(u.Table); err != nil {
+			return err
+		}
+	}
+	for _, p := range parts {
+		done(p.op, p.ips)
+	}
+
+	if delErr != nil {
+		return delErr
+	}
+	return addErr
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"git.cadurx.com/pfdns/backend"
+)
+
+var backendList = flag.String("backend", "pf", "where tables go, pf, file or both as pf,file")
+var exportPath = flag.String("export", "/var/db/pfdns/%s", "file backend path, each %s in the file name is the table name")
+var exportFormat = flag.String("exportformat", backend.FormatPF, "file backend format: pf (for pfctl -T replace -f), list or json")
+var exportReload = flag.String("exportreload", "", "command run after the file backend wrote a table, %s is the table name")
+
+// the file backend, if -backend has it
+var exportFile *backend.File
+
+// newBackend makes the backend -backend asks for
+func newBackend() (backend.Backend, error) {
+	var all backend.Multi
+	for _, name := range strings.Split(*backendList, ",") {
+		switch strings.TrimSpace(name) {
+		case "pf":
+			all = append(all, backend.PF{Dry: *dry})
+		case "file":
+			if exportFile != nil {
+				continue
+			}
+			var err error
+			exportFile, err = backend.NewFile(*exportPath, *exportFormat, strings.Fields(*exportReload))
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, exportFile)
+		default:
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+	}
+
+	if len(all) == 1 {
+		return all[0], nil
+	}
+	return all, nil
+}
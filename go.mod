@@ -1,10 +1,15 @@
 module git.cadurx.com/pfdns
 
-go 1.15
+go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0
 	github.com/miekg/dns v1.1.55
+	golang.org/x/sys v0.9.0
+)
+
+require (
+	golang.org/x/net v0.11.0 // indirect
 	golang.org/x/tools v0.10.0 // indirect
 )
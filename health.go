@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"git.cadurx.com/pfdns/pfdns"
+	"git.cadurx.com/pfdns/resolver"
+)
+
+var healthAddr = flag.String("health", "", "serve health checks over http on this address, e.g. 127.0.0.1:8053")
+
+// how long a health check waits for the main loop and the resolver
+const healthTimeout = 5 * time.Second
+
+// overall health, served with http status 200, 429 and 503 so Consul reads
+// them as passing, warning and critical
+const (
+	healthOK       = "OK"
+	healthDegraded = "DEGRADED"
+	healthFail     = "FAIL"
+)
+
+// the health handler asks the main loop for the supervisor state on it
+var healthC = make(chan chan healthState)
+
+// when we started, for Uptime
+var startTime = time.Now()
+
+type healthState struct {
+	sup     supervisorStatus
+	started bool
+	// nil while the resolver is down
+	m   *pfdns.Manager
+	cfg resolver.Config
+}
+
+// healthReport is served as json
+type healthReport struct {
+	Status  string
+	Reasons []string
+
+	Pid    int
+	Uptime string
+
+	ResolverStarted bool
+	ResolverRunning bool
+	CrashLoop       bool
+
+	// hosts whose last resolve failed
+	FailingHosts int
+	Tables       map[string]tableHealth
+}
+
+type tableHealth struct {
+	// when the host with the oldest answer last got one, and how long ago
+	OldestAnswer time.Time
+	Stale        string
+	// hosts that never got an answer
+	Unresolved int
+	// the backend failed to apply some changes
+	Dirty bool
+}
+
+func (s *supervisor) health() healthState {
+	hs := healthState{sup: s.status(), started: s.started()}
+	if s.rs != nil {
+		hs.m = s.rs.m
+		hs.cfg = s.rs.cfg
+	}
+	return hs
+}
+
+// startHealth listens on healthAddr, before we're sandboxed
+func startHealth() error {
+	if len(*healthAddr) == 0 {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", *healthAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  healthTimeout,
+		WriteTimeout: 2 * healthTimeout,
+	}
+	go func() {
+		err := srv.Serve(l)
+		slog.Error("health endpoint", "err", err)
+	}()
+
+	return nil
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	var rep healthReport
+
+	reply := make(chan healthState, 1)
+	select {
+	case healthC <- reply:
+		rep = checkHealth(<-reply)
+	case <-time.After(healthTimeout):
+		rep = healthReport{Status: healthFail, Reasons: []string{"main loop not responding"}}
+	}
+	rep.Pid = os.Getpid()
+	rep.Uptime = time.Since(startTime).Round(time.Second).String()
+
+	code := http.StatusOK
+	switch rep.Status {
+	case healthDegraded:
+		code = http.StatusTooManyRequests
+	case healthFail:
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// checkHealth asks the resolver for its status and rates it against the
+// config's Health thresholds
+func checkHealth(hs healthState) healthReport {
+	rep := healthReport{
+		Status:          healthOK,
+		ResolverStarted: hs.started,
+		ResolverRunning: hs.m != nil,
+		CrashLoop:       hs.sup.CrashLoop,
+		Tables:          make(map[string]tableHealth),
+	}
+	worse := func(status string, reason string, args ...interface{}) {
+		rep.Reasons = append(rep.Reasons, fmt.Sprintf(reason, args...))
+		if status == healthFail || rep.Status == healthOK {
+			rep.Status = status
+		}
+	}
+
+	switch {
+	case !hs.started:
+		worse(healthFail, "resolver never started")
+		return rep
+	case hs.sup.CrashLoop:
+		worse(healthFail, "resolver crash looping, waiting for reload")
+		return rep
+	case hs.m == nil:
+		worse(healthDegraded, "resolver down, restarting at %s", hs.sup.RestartAt.Format(time.RFC3339))
+		return rep
+	}
+
+	st, err := resolverStatus(hs.m)
+	if err != nil {
+		worse(healthDegraded, "resolver status: %s", err)
+		return rep
+	}
+
+	degradedFailing, failFailing := hs.cfg.Health.Failing()
+	degradedStale, failStale := hs.cfg.Health.Stale()
+	now := time.Now()
+
+	var tables []string
+	for table := range st.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		ts := st.Tables[table]
+		th := tableHealth{Dirty: ts.Dirty}
+
+		for _, host := range ts.Hosts {
+			if host.Failures > 0 {
+				rep.FailingHosts++
+			}
+			// static ips are never resolved
+			if len(host.Outcomes) == 0 {
+				continue
+			}
+			if host.LastOK.IsZero() {
+				th.Unresolved++
+				continue
+			}
+			if th.OldestAnswer.IsZero() || host.LastOK.Before(th.OldestAnswer) {
+				th.OldestAnswer = host.LastOK
+			}
+		}
+
+		if !th.OldestAnswer.IsZero() {
+			stale := now.Sub(th.OldestAnswer)
+			th.Stale = stale.Round(time.Second).String()
+
+			switch {
+			case failStale > 0 && stale >= failStale:
+				worse(healthFail, "table %s stale for %s", table, th.Stale)
+			case degradedStale > 0 && stale >= degradedStale:
+				worse(healthDegraded, "table %s stale for %s", table, th.Stale)
+			}
+		}
+		if ts.Dirty {
+			worse(healthDegraded, "table %s dirty: %s", table, ts.Error)
+		}
+
+		rep.Tables[table] = th
+	}
+
+	switch {
+	case failFailing > 0 && rep.FailingHosts >= failFailing:
+		worse(healthFail, "%d hosts failing", rep.FailingHosts)
+	case degradedFailing > 0 && rep.FailingHosts >= degradedFailing:
+		worse(healthDegraded, "%d hosts failing", rep.FailingHosts)
+	}
+
+	return rep
+}
+
+// resolverStatus requests the resolver's status, giving up after
+// healthTimeout
+func resolverStatus(m *pfdns.Manager) (resolver.Status, error) {
+	type result struct {
+		st  resolver.Status
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		st, err := m.Status()
+		done <- result{st, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.st, r.err
+	case <-time.After(healthTimeout):
+		return resolver.Status{}, fmt.Errorf("timed out")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+	"git.cadurx.com/pfdns/resolver"
+)
+
+// hookEvent is passed to hooks as json, and to commands as PFDNS_*
+// environment variables
+type hookEvent struct {
+	Event string
+	Time  time.Time
+	Table string
+
+	// add and delete
+	IPs    []string
+	Host   string
+	Server string
+	TTL    int64
+	Reason string
+
+	// resolve-failure
+	Outcome  string
+	Failures int
+}
+
+func (ev hookEvent) env() []string {
+	return []string{
+		"PATH=/bin:/usr/bin:/sbin:/usr/sbin:/usr/local/bin",
+		"PFDNS_EVENT=" + ev.Event,
+		"PFDNS_TABLE=" + ev.Table,
+		"PFDNS_IPS=" + strings.Join(ev.IPs, " "),
+		"PFDNS_HOST=" + ev.Host,
+		"PFDNS_SERVER=" + ev.Server,
+		"PFDNS_TTL=" + strconv.FormatInt(ev.TTL, 10),
+		"PFDNS_REASON=" + ev.Reason,
+		"PFDNS_OUTCOME=" + ev.Outcome,
+		"PFDNS_FAILURES=" + strconv.Itoa(ev.Failures),
+	}
+}
+
+// a hook and the events waiting for it, each hook runs one event at a time
+// so a slow one only holds up itself
+type hookRunner struct {
+	hook resolver.Hook
+	q    chan hookEvent
+	// closed once q is closed and empty
+	done chan bool
+}
+
+var hooks struct {
+	mu      sync.Mutex
+	cfg     []resolver.Hook
+	runners []*hookRunner
+}
+
+// setHooks runs the hooks of a new config, the old ones finish the events
+// they have queued
+func setHooks(cfg []resolver.Hook) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+
+	if reflect.DeepEqual(cfg, hooks.cfg) {
+		return
+	}
+
+	for _, r := range hooks.runners {
+		close(r.q)
+	}
+	hooks.cfg = cfg
+	hooks.runners = nil
+
+	for _, h := range cfg {
+		r := &hookRunner{hook: h, q: make(chan hookEvent, h.QueueSize()), done: make(chan bool)}
+		hooks.runners = append(hooks.runners, r)
+		go r.run()
+	}
+}
+
+// fireHooks queues ev for the hooks that want it, never blocks
+func fireHooks(ev hookEvent) {
+	ev.Time = time.Now()
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+
+	for n, r := range hooks.runners {
+		if !r.hook.Wants(ev.Event, ev.Table, ev.Host) {
+			continue
+		}
+		select {
+		case r.q <- ev:
+		default:
+			slog.Warn("hook queue full, dropping event", "hook", n, "event", ev.Event, "table", ev.Table, "host", ev.Host)
+		}
+	}
+}
+
+// hookTableEvent fires an event per host that caused a change the backend
+// applied
+func hookTableEvent(event string, table string, ips []string, whys map[string]backend.Why) {
+	if event == resolver.EventFlush {
+		w := whys[""]
+		fireHooks(hookEvent{Event: event, Table: table, Reason: w.Reason})
+		return
+	}
+
+	byWhy := make(map[backend.Why][]string)
+	var order []backend.Why
+	for _, ip := range ips {
+		w := whys[ip]
+		if _, ok := byWhy[w]; !ok {
+			order = append(order, w)
+		}
+		byWhy[w] = append(byWhy[w], ip)
+	}
+	for _, w := range order {
+		fireHooks(hookEvent{
+			Event:  event,
+			Table:  table,
+			IPs:    byWhy[w],
+			Host:   w.Host,
+			Server: w.Server,
+			TTL:    w.TTL,
+			Reason: w.Reason,
+		})
+	}
+}
+
+// drainHooks runs the events the hooks have queued before we exit, gives up
+// after timeout. no hooks fire after
+func drainHooks(timeout time.Duration) {
+	hooks.mu.Lock()
+	runners := hooks.runners
+	for _, r := range runners {
+		close(r.q)
+	}
+	hooks.runners = nil
+	hooks.mu.Unlock()
+
+	deadline := time.After(timeout)
+	for _, r := range runners {
+		select {
+		case <-r.done:
+		case <-deadline:
+			slog.Warn("hooks still running, dropping their events", "timeout", timeout)
+			return
+		}
+	}
+}
+
+func (r *hookRunner) run() {
+	defer close(r.done)
+
+	for ev := range r.q {
+		err := r.fire(ev)
+		if err != nil {
+			slog.Error("hook failed", "event", ev.Event, "table", ev.Table, "host", ev.Host, "err", err)
+		}
+	}
+}
+
+func (r *hookRunner) fire(ev hookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.hook.TimeoutDuration())
+	defer cancel()
+
+	if len(r.hook.Command) > 0 {
+		cmd := exec.CommandContext(ctx, r.hook.Command[0], r.hook.Command[1:]...)
+		cmd.Env = ev.env()
+		cmd.Stdin = bytes.NewReader(body)
+		// don't wait on whatever it left running with our pipes
+		cmd.WaitDelay = time.Second
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", r.hook.Command[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", r.hook.URL, resp.Status)
+	}
+	return nil
+}
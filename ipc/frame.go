@@ -0,0 +1,97 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// wire format, every message is a frame:
+//
+//	uint32 length of the rest of the frame
+//	uint8  kind
+//	uint32 request id, 0 for calls
+//	fields, each a uint32 length followed by that many bytes
+//
+// all integers are big endian. the first frame in each direction is a hello
+// carrying the protocol version, the reader drops the connection if it
+// doesn't match ours
+const version = "2"
+
+const (
+	kindHello = iota
+	kindCall
+	kindRequest
+	kindResponse
+)
+
+// refuse anything larger, we're talking to ourselves, it's a bug
+const maxFrame = 16 << 20
+
+type frame struct {
+	kind   uint8
+	id     uint32
+	fields []string
+}
+
+func (f frame) marshal() []byte {
+	size := 1 + 4
+	for _, field := range f.fields {
+		size += 4 + len(field)
+	}
+
+	buf := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	buf = append(buf, f.kind)
+	buf = appendUint32(buf, f.id)
+	for _, field := range f.fields {
+		buf = appendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+
+	return buf
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var f frame
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return f, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size < 5 || size > maxFrame {
+		return f, fmt.Errorf("bad frame size %d", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return f, err
+	}
+
+	f.kind = buf[0]
+	f.id = binary.BigEndian.Uint32(buf[1:5])
+	buf = buf[5:]
+
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return f, fmt.Errorf("truncated field")
+		}
+		n := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint32(len(buf)) < n {
+			return f, fmt.Errorf("truncated field")
+		}
+		f.fields = append(f.fields, string(buf[:n]))
+		buf = buf[n:]
+	}
+
+	return f, nil
+}
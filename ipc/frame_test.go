@@ -0,0 +1,207 @@
+package ipc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const timeout = 5 * time.Second
+
+// pair connects a and b, a's calls go to b and b's to a
+func pair(t *testing.T, a *IPC, b *IPC) {
+	t.Helper()
+
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	t.Cleanup(func() {
+		aw.Close()
+		bw.Close()
+	})
+
+	go a.Reader(ar)
+	go b.Reader(br)
+	a.Writer(aw)
+	b.Writer(bw)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	f := frame{
+		kind:   kindCall,
+		id:     7,
+		fields: []string{"add", "line\nbreak", "", "tab\there", "", "end\n"},
+	}
+
+	got, err := readFrame(bytes.NewReader(f.marshal()))
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if got.kind != f.kind || got.id != f.id || fmt.Sprintf("%q", got.fields) != fmt.Sprintf("%q", f.fields) {
+		t.Errorf("got %+v, want %+v", got, f)
+	}
+
+	// and through a Call
+	var a, b IPC
+	calls := make(chan Args, 1)
+	b.Register("add", func(args Args) { calls <- args })
+	pair(t, &a, &b)
+
+	a.Call(Args{Func: "add", Argv: f.fields[1:]})
+	select {
+	case args := <-calls:
+		if fmt.Sprintf("%q", args.Argv) != fmt.Sprintf("%q", f.fields[1:]) {
+			t.Errorf("argv %q, want %q", args.Argv, f.fields[1:])
+		}
+	case <-time.After(timeout):
+		t.Fatalf("call not delivered")
+	}
+}
+
+func TestFrameVersionMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(frame{kind: kindHello, fields: []string{version + "0"}}.marshal())
+	buf.Write(frame{kind: kindCall, fields: []string{"add", "x"}}.marshal())
+
+	var i IPC
+	called := false
+	i.Register("add", func(Args) { called = true })
+	// returns on the bad hello
+	i.Reader(io.NopCloser(&buf))
+
+	if called {
+		t.Errorf("call handled after a version mismatch")
+	}
+	if _, err := i.Request(Args{Func: "x"}); err != ErrClosed {
+		t.Errorf("request after a version mismatch: %v, want ErrClosed", err)
+	}
+}
+
+func TestFrameBad(t *testing.T) {
+	size := func(n uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, n)
+	}
+	good := frame{kind: kindCall, fields: []string{"add", "x"}}.marshal()
+
+	// a field claiming more than is left in the frame
+	badField := append(size(1+4+4), kindCall)
+	badField = append(badField, 0, 0, 0, 0)
+	badField = append(badField, size(100)...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short length", []byte{0, 0}},
+		{"too small", append(size(4), 0, 0, 0, 0)},
+		{"too large", append(size(maxFrame+1), good[4:]...)},
+		{"truncated", good[:len(good)-1]},
+		{"truncated field", badField},
+		{"truncated field length", append(append(size(1+4+2), kindCall, 0, 0, 0, 0), 0, 1)},
+	}
+
+	for _, tt := range tests {
+		if f, err := readFrame(bytes.NewReader(tt.data)); err == nil {
+			t.Errorf("%s: read %+v", tt.name, f)
+		}
+	}
+
+	// the reader drops the connection on a bad frame
+	var buf bytes.Buffer
+	buf.Write(frame{kind: kindHello, fields: []string{version}}.marshal())
+	buf.Write(append(size(maxFrame+1), good[4:]...))
+	buf.Write(good)
+
+	var i IPC
+	called := false
+	i.Register("add", func(Args) { called = true })
+	i.Reader(io.NopCloser(&buf))
+	if called {
+		t.Errorf("call handled after an oversized frame")
+	}
+}
+
+// concurrent requests each get their own response
+func TestFrameRequest(t *testing.T) {
+	var a, b IPC
+	b.RegisterRequest("echo", func(args Args) ([]string, error) {
+		if len(args.Argv) == 0 {
+			return nil, errors.New("nothing to echo")
+		}
+		return args.Argv, nil
+	})
+	pair(t, &a, &b)
+
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			want := []string{strconv.Itoa(n), "", "x\ny"}
+			got, err := a.Request(Args{Func: "echo", Argv: want})
+			if err != nil {
+				t.Errorf("request %d: %s", n, err)
+				return
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+				t.Errorf("request %d got %q", n, got)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if _, err := a.Request(Args{Func: "echo"}); err == nil || err.Error() != "nothing to echo" {
+		t.Errorf("error response: %v", err)
+	}
+	if _, err := a.Request(Args{Func: "nope"}); err == nil {
+		t.Errorf("unknown request answered")
+	}
+}
+
+func TestFrameRequestClosed(t *testing.T) {
+	ar, pw := io.Pipe()
+	pr, aw := io.Pipe()
+	defer pr.Close()
+
+	var a IPC
+	go a.Reader(ar)
+
+	// the peer says hello, takes the request and hangs up
+	_, _ = pw.Write(frame{kind: kindHello, fields: []string{version}}.marshal())
+	go func() {
+		for {
+			f, err := readFrame(pr)
+			if err != nil {
+				return
+			}
+			if f.kind == kindRequest {
+				pw.Close()
+			}
+		}
+	}()
+	a.Writer(aw)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Request(Args{Func: "status"})
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Errorf("request got %v, want ErrClosed", err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("request still waiting after the peer hung up")
+	}
+
+	if _, err := a.Request(Args{Func: "status"}); err != ErrClosed {
+		t.Errorf("request after close got %v, want ErrClosed", err)
+	}
+}
@@ -1,15 +1,30 @@
 package ipc
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
 // Func IPC calls should confirm to this interface
 type Func func(Args)
 
+// RequestFunc IPC requests should confirm to this interface, the returned
+// strings (or error) are sent back to the caller of IPC.Request()
+type RequestFunc func(Args) ([]string, error)
+
 // IPC type
 type IPC struct {
-	w io.Writer
+	w   io.Writer
+	wmu sync.Mutex
 
 	subs map[string]Func
+	reqs map[string]RequestFunc
+
+	// requests waiting for a response, by id
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	closed  bool
 }
 
 // Args populate and then call IPC.Call()
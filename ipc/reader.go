@@ -1,16 +1,17 @@
 package ipc
 
 import (
-	"bufio"
-	"bytes"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
 )
 
 // handles reading bits
 
 func ipcError(args Args) {
-	log.Printf("child had error: %s", args)
+	slog.Error("child had error", "err", strings.Join(args.Argv, " "))
 }
 
 // Register a func with a callback
@@ -22,37 +23,137 @@ func (i *IPC) Register(f string, cb Func) {
 	i.subs[f] = cb
 }
 
+// RegisterRequest a func with a callback whose return value is sent back to
+// the caller of Request()
+func (i *IPC) RegisterRequest(f string, cb RequestFunc) {
+	if i.reqs == nil {
+		i.reqs = make(map[string]RequestFunc, 10)
+	}
+	i.reqs[f] = cb
+}
+
 // Reader usage go Reader(r), Reader now owns r (will call r.Close() on EOF)
-// calls callbacks registered with Register()
-func (i *IPC) Reader(r *os.File) {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		fields := bytes.Split(line, []byte{0})
-
-		if len(fields) > 0 && len(string(fields[0])) > 1 {
-			name := string(fields[0])
-
-			sub, ok := i.subs[name]
-			if ok {
-				args := Args{}
-				for i, a := range fields {
-					if i == 0 || len(string(a)) == 0 {
-						continue
-					}
-					args.Argv = append(args.Argv, string(a))
-				}
-				args.Func = name
-				sub(args)
-			} else {
-				log.Printf("unknown ipc call: %s", name)
+// calls callbacks registered with Register() in the order they were sent
+func (i *IPC) Reader(r io.ReadCloser) {
+	defer i.close(r)
+
+	hello, err := readFrame(r)
+	if err != nil {
+		if err != io.EOF {
+			slog.Error("ipc hello", "err", err)
+		}
+		return
+	}
+	if hello.kind != kindHello || len(hello.fields) != 1 || hello.fields[0] != version {
+		slog.Error("ipc version mismatch", "want", version, "got", hello.fields)
+		return
+	}
+
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				slog.Error("ipc read", "err", err)
 			}
+			return
+		}
+
+		switch f.kind {
+		case kindCall:
+			i.call(f)
+		case kindRequest:
+			i.request(f)
+		case kindResponse:
+			i.response(f)
+		default:
+			slog.Warn("unknown ipc frame", "kind", f.kind)
+		}
+	}
+}
+
+func frameArgs(f frame) (Args, bool) {
+	if len(f.fields) == 0 || len(f.fields[0]) == 0 {
+		slog.Warn("ipc frame without func")
+		return Args{}, false
+	}
+	return Args{Func: f.fields[0], Argv: f.fields[1:]}, true
+}
+
+func (i *IPC) call(f frame) {
+	args, ok := frameArgs(f)
+	if !ok {
+		return
+	}
+
+	sub, ok := i.subs[args.Func]
+	if !ok {
+		slog.Warn("unknown ipc call", "func", args.Func)
+		return
+	}
+	sub(args)
+}
+
+func (i *IPC) request(f frame) {
+	args, ok := frameArgs(f)
+	if !ok {
+		return
+	}
+
+	// the first field of a response is the error, empty on success
+	var fields []string
+	req, ok := i.reqs[args.Func]
+	if ok {
+		argv, err := req(args)
+		if err != nil {
+			fields = []string{err.Error()}
 		} else {
-			log.Printf("got line %s", line)
+			fields = append([]string{""}, argv...)
 		}
+	} else {
+		slog.Warn("unknown ipc request", "func", args.Func)
+		fields = []string{"unknown ipc request: " + args.Func}
+	}
+
+	err := i.write(frame{kind: kindResponse, id: f.id, fields: fields})
+	if err != nil {
+		slog.Error("ipc response", "func", args.Func, "err", err)
+	}
+}
+
+func (i *IPC) response(f frame) {
+	i.mu.Lock()
+	wait, ok := i.pending[f.id]
+	delete(i.pending, f.id)
+	i.mu.Unlock()
+
+	if !ok {
+		slog.Warn("ipc response for unknown request", "id", f.id)
+		return
 	}
 
+	var r response
+	switch {
+	case len(f.fields) == 0:
+		r.err = fmt.Errorf("empty ipc response")
+	case len(f.fields[0]) > 0:
+		r.err = errors.New(f.fields[0])
+	default:
+		r.argv = f.fields[1:]
+	}
+	wait <- r
+}
+
+// close fails any requests still waiting for a response
+func (i *IPC) close(r io.Closer) {
 	// we own r, so close it
 	_ = r.Close()
-	//log.Printf("ipc reader done")
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.closed = true
+	for id, wait := range i.pending {
+		wait <- response{err: ErrClosed}
+		delete(i.pending, id)
+	}
 }
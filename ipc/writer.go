@@ -1,44 +1,109 @@
 package ipc
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"os"
+
+	"git.cadurx.com/pfdns/logging"
 )
 
 // handles writing/calling
 
-// Writer sets where to write to on IPC.Call()
+type response struct {
+	argv []string
+	err  error
+}
+
+// ErrClosed returned by Request() when the other end went away
+var ErrClosed = errors.New("ipc closed")
+
+// Writer sets where to write to on IPC.Call(), sends our protocol version
 func (i *IPC) Writer(w io.Writer) {
 	i.w = w
+
+	hello := frame{kind: kindHello, fields: []string{version}}
+	if err := i.write(hello); err != nil {
+		slog.Error("ipc hello", "err", err)
+	}
+}
+
+func (i *IPC) write(f frame) error {
+	buf := f.marshal()
+
+	i.wmu.Lock()
+	defer i.wmu.Unlock()
+
+	cnt, err := i.w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("write failed: %s", err)
+	}
+
+	if cnt != len(buf) {
+		return fmt.Errorf("wrote %d of %d, goodbye", cnt, len(buf))
+	}
+
+	return nil
 }
 
 // WriteFatal a fatal error, then die
 func (i *IPC) WriteFatal(err error) {
-	// ignore errors, not much we can do anway
-	_, _ = i.w.Write([]byte("error"))
-	_, _ = i.w.Write([]byte{0})
-	_, _ = i.w.Write([]byte(err.Error()))
-	_, _ = i.w.Write([]byte{'\n'})
-	log.Fatal(err)
+	// the other end logs it, if it's still there
+	if i.Send(Args{Func: "error", Argv: []string{err.Error()}}) != nil {
+		logging.Fatal("fatal", "err", err)
+	}
+	os.Exit(1)
 }
 
-// Call execute IPC on Writer
+// Call execute IPC on Writer, dies if the write fails
 func (i *IPC) Call(arg Args) {
-	var buf []byte
-	buf = append(buf, []byte(arg.Func)...)
-	buf = append(buf, 0)
-	for _, a := range arg.Argv {
-		buf = append(buf, []byte(a)...)
-		buf = append(buf, 0)
-	}
-	buf = append(buf, '\n')
-	cnt, err := i.w.Write(buf)
-
+	err := i.Send(arg)
 	if err != nil {
-		log.Fatalf("write failed: %s", err)
+		logging.Fatal("ipc call", "func", arg.Func, "err", err)
 	}
+}
 
-	if cnt != len(buf) {
-		log.Fatalf("wrote %d of %d, goodbye", cnt, len(buf))
+// Send execute IPC on Writer, returning write errors to the caller
+func (i *IPC) Send(arg Args) error {
+	f := frame{
+		kind:   kindCall,
+		fields: append([]string{arg.Func}, arg.Argv...),
 	}
+	return i.write(f)
+}
+
+// Request execute IPC on Writer and wait for the RequestFunc registered on the
+// other end to return. the response is read by Reader(), so it must be
+// running, and must not be called from a registered callback
+func (i *IPC) Request(arg Args) ([]string, error) {
+	i.mu.Lock()
+	if i.closed {
+		i.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if i.pending == nil {
+		i.pending = make(map[uint32]chan response)
+	}
+	i.nextID++
+	id := i.nextID
+	wait := make(chan response, 1)
+	i.pending[id] = wait
+	i.mu.Unlock()
+
+	f := frame{
+		kind:   kindRequest,
+		id:     id,
+		fields: append([]string{arg.Func}, arg.Argv...),
+	}
+	if err := i.write(f); err != nil {
+		i.mu.Lock()
+		delete(i.pending, id)
+		i.mu.Unlock()
+		return nil, err
+	}
+
+	r := <-wait
+	return r.argv, r.err
 }
@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// forwardHandler hands records to send as strings: time, level, message,
+// then key/value pairs with json values. Replay logs them on the other end
+type forwardHandler struct {
+	send  func([]string) error
+	level slog.Leveler
+
+	// key/value pairs from WithAttrs, and the WithGroup key prefix
+	attrs  []string
+	prefix string
+}
+
+// Forward returns a handler sending records at level and up with send
+func Forward(send func([]string) error, level slog.Leveler) slog.Handler {
+	return &forwardHandler{send: send, level: level}
+}
+
+func (f *forwardHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= f.level.Level()
+}
+
+func (f *forwardHandler) Handle(_ context.Context, r slog.Record) error {
+	argv := []string{r.Time.Format(time.RFC3339Nano), r.Level.String(), r.Message}
+	argv = append(argv, f.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		argv = appendAttr(argv, f.prefix, a)
+		return true
+	})
+
+	err := f.send(argv)
+	if err != nil {
+		// the other end is gone, stderr is all we have
+		fmt.Fprintf(os.Stderr, "%s %s %s %s\n", argv[0], argv[1], argv[2], strings.Join(argv[3:], " "))
+	}
+	return nil
+}
+
+func (f *forwardHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *f
+	c.attrs = append([]string{}, f.attrs...)
+	for _, a := range attrs {
+		c.attrs = appendAttr(c.attrs, f.prefix, a)
+	}
+	return &c
+}
+
+func (f *forwardHandler) WithGroup(name string) slog.Handler {
+	c := *f
+	c.prefix = f.prefix + name + "."
+	return &c
+}
+
+// appendAttr flattens groups into dotted keys
+func appendAttr(argv []string, prefix string, a slog.Attr) []string {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if len(a.Key) > 0 {
+			prefix += a.Key + "."
+		}
+		for _, g := range a.Value.Group() {
+			argv = appendAttr(argv, prefix, g)
+		}
+		return argv
+	}
+	if a.Equal(slog.Attr{}) {
+		return argv
+	}
+
+	var v any
+	switch a.Value.Kind() {
+	case slog.KindDuration:
+		v = a.Value.Duration().String()
+	default:
+		v = a.Value.Any()
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return append(argv, prefix+a.Key, string(b))
+}
+
+// Replay logs a record from Forward with the default handler, whatever its
+// level, the sender already filtered. attrs are added to it
+func Replay(argv []string, attrs ...slog.Attr) error {
+	if len(argv) < 3 || len(argv)%2 == 0 {
+		return fmt.Errorf("bad log record %q", argv)
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, argv[0])
+	if err != nil {
+		return err
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(argv[1])); err != nil {
+		return err
+	}
+
+	r := slog.NewRecord(t, l, argv[2], 0)
+	r.AddAttrs(attrs...)
+	for n := 3; n < len(argv); n += 2 {
+		d := json.NewDecoder(strings.NewReader(argv[n+1]))
+		d.UseNumber()
+
+		var v any
+		if err := d.Decode(&v); err != nil {
+			v = argv[n+1]
+		}
+		r.AddAttrs(slog.Any(argv[n], v))
+	}
+
+	return slog.Default().Handler().Handle(context.Background(), r)
+}
@@ -0,0 +1,54 @@
+// Package logging sets up slog for the parent, writing text, json or to
+// syslog, and for the resolver, forwarding its records to the parent
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Level of the default logger, the resolver lowers it to debug when its
+// config is verbose
+var Level = new(slog.LevelVar)
+
+// SetLevel parses level ("debug", "info", "warn", "error")
+func SetLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	Level.Set(l)
+	return nil
+}
+
+// Setup points the default logger, and the stdlib log, at format: "text"
+// or "json" on stderr, or "syslog"
+func Setup(format string) error {
+	opts := &slog.HandlerOptions{Level: Level}
+
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	case "syslog":
+		var err error
+		h, err = newSyslogHandler(opts)
+		if err != nil {
+			return fmt.Errorf("syslog: %s", err)
+		}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// Fatal logs msg at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// syslogHandler formats records as text without time and level, syslogd
+// adds those, and writes them with the record's priority
+type syslogHandler struct {
+	w *syslog.Writer
+
+	// shared with the handlers WithAttrs/WithGroup derive
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+
+	h slog.Handler
+}
+
+func newSyslogHandler(opts *slog.HandlerOptions) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "pfdns")
+	if err != nil {
+		return nil, err
+	}
+
+	o := *opts
+	o.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+			return slog.Attr{}
+		}
+		return a
+	}
+
+	buf := &bytes.Buffer{}
+	return &syslogHandler{
+		w:   w,
+		mu:  &sync.Mutex{},
+		buf: buf,
+		h:   slog.NewTextHandler(buf, &o),
+	}, nil
+}
+
+func (s *syslogHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return s.h.Enabled(ctx, l)
+}
+
+func (s *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.Reset()
+	if err := s.h.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(s.buf.String(), "\n")
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return s.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return s.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
+
+func (s *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *s
+	c.h = s.h.WithAttrs(attrs)
+	return &c
+}
+
+func (s *syslogHandler) WithGroup(name string) slog.Handler {
+	c := *s
+	c.h = s.h.WithGroup(name)
+	return &c
+}
@@ -3,142 +3,259 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"os"
 	"os/signal"
 
-	"git.cadurx.com/pfdns/ipc"
+	"git.cadurx.com/pfdns/logging"
+	"git.cadurx.com/pfdns/pfdns"
 	"git.cadurx.com/pfdns/resolver"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/kardianos/osext"
 )
 
 var cfgPath = flag.String("cfg", "./pfdns.json", "config file path")
 var noFlush = flag.Bool("noflush", false, "don't flush tables")
 var resolvConf = flag.String("resolv", "/etc/resolv.conf", "resolv.conf path")
-var verbose = flag.Bool("verbose", false, "verbose")
-var noChroot = flag.Bool("nochroot", false, "disable chroot/setuid(nobody)")
+var verbose = flag.Bool("verbose", false, "verbose, same as -loglevel debug")
+var logFormat = flag.String("log", "text", "log to stderr as text or json, or to syslog")
+var logLevel = flag.String("loglevel", "info", "debug, info, warn or error")
+var noChroot = flag.Bool("nochroot", false, "disable chroot/setuid")
+var runUser = flag.String("user", "nobody", "user the resolver runs as")
+var runGroup = flag.String("group", "", "group the resolver runs as, default the user's")
+var chrootDir = flag.String("chroot", "/var/empty", "resolver chroot, root owned and not writable")
 var dry = flag.Bool("dry", false, "dry run (don't execute pf)")
 
+// our binary, re-executed as the resolver
+var exePath string
+
 // are we a resolver process?
 var isResolver = flag.Int("resolver", 0, "internal flag")
 
 type resolverState struct {
 	quit chan error
-	proc *os.Process
+	proc resolverProc
+
+	// m applies the resolver's table changes, we send it reload messages
+	// and requests through it
+	m *pfdns.Manager
+	// cfg is the config the resolver is running with
+	cfg resolver.Config
+	// stops handleEvents, closed once it's done
+	stopEvents func()
+	eventsDone chan bool
+
+	started time.Time
 }
 
 func main() {
 	flag.Parse()
 
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	// the resolver parses the same flags, and forwards what it logs to us
+	if err := logging.SetLevel(*logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "-loglevel: %s\n", err)
+		os.Exit(2)
+	}
+	if *verbose {
+		logging.Level.Set(slog.LevelDebug)
+	}
 
 	// resolver subprocess?
 	if *isResolver > 0 {
-		resolver.Main(*noChroot)
+		resolver.Main(*noChroot, resolver.Privs{
+			User:   *runUser,
+			Group:  *runGroup,
+			Chroot: *chrootDir,
+		})
 		return
 	}
 
-	// register IPC callbacks for resolver subprocess to call
-	i := &ipc.IPC{}
-	pfIPCInit(i)
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "audit":
+			os.Exit(auditQuery(flag.Args()[1:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+			os.Exit(2)
+		}
+	}
+
+	if err := logging.Setup(*logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "-log: %s\n", err)
+		os.Exit(2)
+	}
+
+	var err error
+	fw, err = newBackend()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-backend: %s\n", err)
+		os.Exit(2)
+	}
+
+	// so we can match them against fsnotify events
+	for _, p := range []*string{cfgPath, resolvConf} {
+		if abs, err := filepath.Abs(*p); err == nil {
+			*p = abs
+		}
+	}
 
 	quitSig := make(chan os.Signal, 1)
 	signal.Notify(quitSig, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGQUIT)
 	reloadSig := make(chan os.Signal, 1)
 	signal.Notify(reloadSig, syscall.SIGHUP)
+	statusSig := make(chan os.Signal, 1)
+	signal.Notify(statusSig, syscall.SIGUSR1)
+
+	// looked up once, we can't search for it once we're unveiled
+	if !*single {
+		exePath, err = osext.Executable()
+		if err != nil {
+			logging.Fatal("can't find our executable", "err", err)
+		}
+	}
+
+	if err := openAudit(); err != nil {
+		logging.Fatal("can't open audit log", "path", *auditPath, "err", err)
+	}
+	if err := startHealth(); err != nil {
+		logging.Fatal("can't serve health checks", "addr", *healthAddr, "err", err)
+	}
 
 	// start the resolver subprocess
-	resolverState := startResolver(i)
+	sup := &supervisor{}
+	sup.start()
 
 	// reload if resolvConf or cfgFile files change
-	watcher := watchFiles()
+	watcher := watchFiles(*cfgPath, *resolvConf)
 
-	// we need __set_tcb and we have no way to get it :-(
-	// pledge.Pledge("stdio proc exec rpath", nil)
+	err = sandbox(exePath)
+	if err != nil {
+		logging.Fatal("sandbox", "err", err)
+	}
 
 	for {
 		select {
 		case s := <-quitSig:
-			log.Fatalf("exiting: got sig %s", s)
+			shutdown(sup, s)
 		case s := <-reloadSig:
-			log.Printf("got sig %s, reloading config", s)
-
-			// will respawn when we get <-resolverState.quit
-			resolverState.proc.Kill()
-		case evt := <-watcher.Events:
-			if evt.Name == *cfgPath || evt.Name == *resolvConf {
-				if evt.Op&fsnotify.Write == fsnotify.Write {
-					log.Printf("%s modified, reloading", evt.Name)
-
-					// will respawn when we get <-resolverState.quit
-					resolverState.proc.Kill()
-				}
-			}
-		case err := <-watcher.Errors:
-			log.Printf("watcher err: %s", err)
-		case err := <-resolverState.quit:
-			// set by a startup IPC message in pf.go
-			if resolverStarted() {
-				log.Printf("resolver died: %s", err)
-				resolverState = startResolver(i)
+			slog.Info("reloading config", "sig", s)
+			reopenAudit()
+			sup.reload()
+		case <-statusSig:
+			requestStatus(sup)
+		case reply := <-healthC:
+			reply <- sup.health()
+		case path := <-watcher.Changed:
+			slog.Info("file modified, reloading", "path", path)
+
+			if path == *cfgPath {
+				sup.reload()
 			} else {
-				log.Fatalf("resolver died in init %s", err)
+				// nameservers changed, everything needs re-resolving
+				sup.restart("resolv.conf changed")
 			}
+		case err := <-sup.quit():
+			sup.died(err)
+		case <-sup.restartC:
+			sup.start()
 		}
 	}
 }
 
-func watchFiles() *fsnotify.Watcher {
-	watcher, err := fsnotify.NewWatcher()
+func readConfig() (resolver.Config, error) {
+	f, err := os.Open(*cfgPath)
 	if err != nil {
-		log.Fatal(err)
+		return resolver.Config{}, err
 	}
+	defer f.Close()
 
-	// we have to watch on the dir, editors rename/remove the old file
-	err = watcher.Add(filepath.Dir(*resolvConf))
+	return resolver.ParseConfig(f)
+}
+
+// reload diffs the config against the one the resolver is running and sends
+// it just the changes, so unchanged tables and hosts keep their IPs. returns
+// true if that is not possible and the resolver needs restarting
+func reload(rs *resolverState) bool {
+	cfg, err := readConfig()
 	if err != nil {
-		log.Printf("can't watch %s: %s", *resolvConf, err)
+		slog.Error("not reloading", "path", *cfgPath, "err", err)
+		return false
 	}
-	err = watcher.Add(filepath.Dir(*cfgPath))
-	if err != nil {
-		log.Printf("can't watch %s: %s", *cfgPath, err)
+
+	changes, restart := resolver.Diff(rs.cfg, cfg)
+	if restart {
+		return true
 	}
 
-	return watcher
+	for _, c := range changes {
+		slog.Info("reload", "op", c.Op, "table", c.Table, "host", c.Host)
+
+		err := rs.m.Change(c)
+		if err != nil {
+			slog.Error("reload failed", "err", err)
+			return true
+		}
+	}
+
+	rs.cfg = cfg
+	setHooks(cfg.Hooks)
+	return false
+}
+
+// resolverProc is the resolver subprocess, or the resolver in our process
+type resolverProc interface {
+	// stop lets the resolver send its pending table updates first
+	stop()
+	kill()
+}
+
+type subprocess struct {
+	*os.Process
 }
 
-func startResolver(i *ipc.IPC) resolverState {
+func (p subprocess) stop() { _ = p.Signal(syscall.SIGTERM) }
+func (p subprocess) kill() { _ = p.Kill() }
+
+func startResolver() *resolverState {
+	if *single {
+		return startInProcess()
+	}
+
 	args := os.Args
 	args = append(args, "-resolver", fmt.Sprintf("%d", os.Getpid()))
 
-	// pipes for parent/child death detection
+	// pipes for parent/child death detection and reload messages
 	// if the parent dies, the child will detect it via rp and exit
 	rp, wp, err := os.Pipe()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("pipe", "err", err)
 	}
 
 	// ipc pipes
 	rcomp, wcomp, err := os.Pipe()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("pipe", "err", err)
 	}
 
 	// open config and pass it to resolverProcess to parse after dropping privs/chrooting
 	resolv, err := os.Open(*resolvConf)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("can't open resolv.conf", "err", err)
 	}
 	conf, err := os.Open(*cfgPath)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("can't open config", "err", err)
 	}
 
+	// our copy to diff against on reload, the resolver reports errors itself
+	cfg, _ := readConfig()
+	setHooks(cfg.Hooks)
+	setKillStates(cfg.TableOptions)
+
 	attr := &os.ProcAttr{
 		Files: []*os.File{
 			os.Stdin,
@@ -152,27 +269,23 @@ func startResolver(i *ipc.IPC) resolverState {
 		},
 	}
 
-	exe, err := osext.Executable()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	proc, err := os.StartProcess(exe, args, attr)
+	proc, err := os.StartProcess(exePath, args, attr)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("can't start resolver", "err", err)
 	}
 
-	// closed on exit so child can detect parent death
-	_ = wp
-
 	// not needed any longer
 	_ = rp.Close()
 	_ = wcomp.Close()
 	_ = conf.Close()
 	_ = resolv.Close()
 
-	// start processing IPC for our subprocess
-	go i.Reader(rcomp)
+	// apply the table changes our subprocess sends on rcomp, we send reload
+	// messages and responses on wp. it's closed on exit so the child can
+	// detect parent death
+	m := pfdns.New(fw)
+	stopEvents, eventsDone := subscribe(m)
+	m.Attach(rcomp, wp)
 
 	// detect child death
 	var childQuit = make(chan error)
@@ -187,8 +300,15 @@ func startResolver(i *ipc.IPC) resolverState {
 		}
 	}()
 
-	return resolverState{
+	return &resolverState{
 		quit: childQuit,
-		proc: proc,
+		proc: subprocess{proc},
+		m:    m,
+		cfg:  cfg,
+
+		stopEvents: stopEvents,
+		eventsDone: eventsDone,
+
+		started: time.Now(),
 	}
 }
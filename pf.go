@@ -1,88 +1,78 @@
 package main
 
 import (
-	"log"
-	"os/exec"
-	"sync"
+	"log/slog"
+	"time"
 
-	"git.cadurx.com/pfdns/ipc"
+	"git.cadurx.com/pfdns/backend"
+	"git.cadurx.com/pfdns/pfdns"
+	"git.cadurx.com/pfdns/resolver"
 )
 
-func pfIPCInit(i *ipc.IPC) {
-	i.Register("flushTable", flushTable)
-	i.Register("addToTable", addToTable)
-	i.Register("delToTable", delToTable)
-	i.Register("startup", startup)
+// the firewall the resolver's changes are applied to
+var fw backend.Backend
+
+// how many events the resolver can get ahead of handleEvents
+const eventBuffer = 100
+
+// subscribe runs handleEvents on m's events. done is closed once it handled
+// the last of them
+func subscribe(m *pfdns.Manager) (cancel func(), done chan bool) {
+	events, cancel := m.Subscribe(eventBuffer)
+	done = make(chan bool)
+	go func() {
+		handleEvents(events)
+		close(done)
+	}()
+	return cancel, done
 }
 
-// the resolver sends a startup message if it could start and process the config
-// if there were syntax errors or somesuch, we want to exit. which we detect by
-// seeing if the resolverStarted() in our main process, if so we respawn it,
-// otherwise we will assume we couldn't start the resolver and treat it as a
-// fatal error in the main process
-var _resolverStarted bool
-var _rlock sync.Mutex
-
-func resolverStarted() bool {
-	_rlock.Lock()
-	defer _rlock.Unlock()
-	return _resolverStarted
-}
-
-func startup(args ipc.Args) {
-	_rlock.Lock()
-	defer _rlock.Unlock()
-	_resolverStarted = true
-}
-
-func flushTable(args ipc.Args) {
-	log.Printf("flushing table %s", args.Argv[0])
-
-	if *dry {
-		return
+// drainEvents waits for handleEvents to audit and fire the hooks for what
+// the stopped resolver changed last, gives up after timeout
+func (rs *resolverState) drainEvents(timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	// the manager publishes everything it read before it sees the
+	// resolver's pipe close
+	select {
+	case <-rs.m.Done():
+	case <-deadline:
+		slog.Warn("resolver pipe still open, dropping its last events")
 	}
+	rs.stopEvents()
 
-	cmd := exec.Command("/sbin/pfctl", "-q", "-t", args.Argv[0], "-T", "flush")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("pfctl %s: %s", err, out)
+	select {
+	case <-rs.eventsDone:
+	case <-deadline:
+		slog.Warn("events not handled in time, dropping them", "timeout", timeout)
 	}
 }
 
-func delToTable(args ipc.Args) {
-	if len(args.Argv) <= 1 {
-		return
-	}
-
-	if *dry {
-		return
-	}
-
-	cargs := []string{"-t", args.Argv[0], "-T", "delete"}
-	cargs = append(cargs, args.Argv[1:]...)
-
-	cmd := exec.Command("/sbin/pfctl", cargs...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("pfctl %s %s: %s", cargs, err, out)
+// handleEvents audits and fires the hooks for the resolver's events, until
+// it goes away
+func handleEvents(events <-chan pfdns.Event) {
+	for ev := range events {
+		switch ev.Op {
+		case resolver.EventResolveFailure:
+			fireHooks(hookEvent{
+				Event:    ev.Op,
+				Table:    ev.Table,
+				Host:     ev.Host,
+				Outcome:  ev.Outcome,
+				Failures: ev.Failures,
+			})
+		case backend.OpDelete:
+			applied(ev.Op, ev.Table, ev.IPs, ev.Why)
+			killTableStates(ev.Table, ev.IPs)
+		default:
+			applied(ev.Op, ev.Table, ev.IPs, ev.Why)
+		}
 	}
 }
 
-func addToTable(args ipc.Args) {
-	if len(args.Argv) <= 1 {
-		return
-	}
-
-	if *dry {
-		return
-	}
-
-	cargs := []string{"-t", args.Argv[0], "-T", "add"}
-	cargs = append(cargs, args.Argv[1:]...)
-
-	cmd := exec.Command("/sbin/pfctl", cargs...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("pfctl %s %s: %s", cargs, err, out)
-	}
+// applied records a change the backend made in the audit log and fires the
+// hooks for it
+func applied(op string, table string, ips []string, whys map[string]backend.Why) {
+	auditLog(op, table, ips, whys)
+	hookTableEvent(op, table, ips, whys)
 }
@@ -0,0 +1,397 @@
+// Package pfdns keeps firewall tables filled with the addresses hostnames
+// resolve to. a Manager drives a resolver, in process or in pfdns'
+// privilege separated subprocess, and applies the changes it sends to a
+// Backend
+package pfdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.cadurx.com/pfdns/backend"
+	"git.cadurx.com/pfdns/ipc"
+	"git.cadurx.com/pfdns/logging"
+	"git.cadurx.com/pfdns/resolver"
+)
+
+// Backend is a firewall's address tables, see backend.PF for pf's
+type Backend = backend.Backend
+
+// Event is a change the Backend applied to a table, or a host that failed
+// to resolve
+type Event struct {
+	// backend.OpFlush, OpDelete, OpAdd or resolver.EventResolveFailure
+	Op    string
+	Table string
+
+	// flush, delete and add. why each ip changed, the flush's is Why[""]
+	IPs []string
+	Why map[string]backend.Why
+
+	// resolve failures, consecutive Failures
+	Host     string
+	Outcome  string
+	Failures int
+}
+
+// Manager applies a resolver's table changes to a Backend and passes on
+// its own changes to the resolver
+type Manager struct {
+	b   Backend
+	ctl *ipc.IPC
+
+	// for a resolver we started, Close drains it and closes its pipes
+	drain     func()
+	closers   []io.Closer
+	closeOnce sync.Once
+	// closed when the resolver went away
+	done chan bool
+
+	mu      sync.Mutex
+	started bool
+	tables  map[string]map[string]bool
+	subs    map[*subscriber]bool
+
+	// held while publishing, so events go out in order without holding mu
+	pubMu sync.Mutex
+}
+
+type subscriber struct {
+	c    chan Event
+	done chan bool
+	once sync.Once
+
+	// held while sending on c, and to close it
+	mu     sync.Mutex
+	closed bool
+}
+
+// send ev unless s is cancelled, waiting for it to take it
+func (s *subscriber) send(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- ev:
+	case <-s.done:
+	}
+}
+
+// close c once a send in progress is done
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.c)
+	}
+}
+
+// Options of a resolver running in process
+type Options struct {
+	// json as in pfdns.json, its Tables are resolved right away. default
+	// no tables, add hosts with AddHost
+	Config io.Reader
+	// nameservers as in resolv.conf, default /etc/resolv.conf's
+	ResolvConf io.Reader
+	// nil is the real clock
+	Clock resolver.Clock
+}
+
+// New Manager applying changes to b. Subscribe, then Start a resolver or
+// Attach to one
+func New(b Backend) *Manager {
+	return &Manager{
+		b:      b,
+		ctl:    &ipc.IPC{},
+		tables: make(map[string]map[string]bool),
+		subs:   make(map[*subscriber]bool),
+		done:   make(chan bool),
+	}
+}
+
+// Start a resolver in this process, without privilege separation. Close
+// stops it
+func (m *Manager) Start(opts Options) error {
+	if opts.Config == nil {
+		opts.Config = strings.NewReader("{}")
+	}
+	if opts.ResolvConf == nil {
+		f, err := os.Open("/etc/resolv.conf")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		opts.ResolvConf = f
+	}
+
+	// os pipes, like the subprocess has, they buffer the ipc hellos both
+	// ends write before reading
+	resolverR, toResolver, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	toParent, resolverW, err := os.Pipe()
+	if err != nil {
+		_ = resolverR.Close()
+		_ = toResolver.Close()
+		return err
+	}
+
+	m.Attach(toParent, toResolver)
+	// the resolver stops once its reader sees eof, ours once it does
+	m.closers = []io.Closer{toResolver, resolverW}
+
+	m.drain, err = resolver.Serve(resolverR, resolverW, opts.ResolvConf, opts.Config, opts.Clock)
+	if err != nil {
+		m.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Attach to a resolver we talk to over r and w, like pfdns' resolver
+// subprocess on its fds 3 and 4
+func (m *Manager) Attach(r io.ReadCloser, w io.Writer) {
+	m.ctl.RegisterRequest("updateTable", m.updateTable)
+	m.ctl.Register("startup", m.startup)
+	m.ctl.Register("log", resolverLog)
+	m.ctl.Register(resolver.ResolveFailed, m.resolveFailed)
+	m.ctl.Writer(w)
+
+	go func() {
+		m.ctl.Reader(r)
+		m.gone()
+	}()
+}
+
+// Close stops a resolver Start started, once the Backend applied its
+// pending changes
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() {
+		if m.drain != nil {
+			m.drain()
+		}
+		m.Kill()
+	})
+}
+
+// Kill stops a resolver Start started right away, dropping its pending
+// changes. a Close still draining gives up
+func (m *Manager) Kill() {
+	for _, c := range m.closers {
+		_ = c.Close()
+	}
+}
+
+// Done is closed when the resolver went away, or we stopped it
+func (m *Manager) Done() <-chan bool {
+	return m.done
+}
+
+// Started is true once the resolver parsed its config and came up
+func (m *Manager) Started() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.started
+}
+
+// AddTable starts managing table, flushing it
+func (m *Manager) AddTable(table string) error {
+	return m.Change(resolver.Change{Op: resolver.AddTable, Table: table})
+}
+
+// RemoveTable stops resolving table's hosts, the table is left as the
+// config's RemovedTables says
+func (m *Manager) RemoveTable(table string) error {
+	return m.Change(resolver.Change{Op: resolver.DelTable, Table: table})
+}
+
+// AddHost resolves host into table, adding the table if it's new
+func (m *Manager) AddHost(table string, host string) error {
+	if err := m.AddTable(table); err != nil {
+		return err
+	}
+	return m.Change(resolver.Change{Op: resolver.AddHost, Table: table, Host: host})
+}
+
+// RemoveHost stops resolving host, its ips no other host in the table
+// resolves to are deleted
+func (m *Manager) RemoveHost(table string, host string) error {
+	return m.Change(resolver.Change{Op: resolver.DelHost, Table: table, Host: host})
+}
+
+// Change sends the resolver a change, as resolver.Diff returns them
+func (m *Manager) Change(c resolver.Change) error {
+	argv := []string{c.Table}
+	if len(c.Host) > 0 {
+		argv = append(argv, c.Host)
+	}
+	return m.ctl.Send(ipc.Args{Func: c.Op, Argv: argv})
+}
+
+// Tables returns the sorted ips the Backend has in each table, as far as
+// we changed them
+func (m *Manager) Tables() map[string][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tables := make(map[string][]string, len(m.tables))
+	for table, set := range m.tables {
+		ips := make([]string, 0, len(set))
+		for ip := range set {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		tables[table] = ips
+	}
+	return tables
+}
+
+// Status asks the resolver for its status
+func (m *Manager) Status() (resolver.Status, error) {
+	var st resolver.Status
+
+	argv, err := m.ctl.Request(ipc.Args{Func: "getStatus"})
+	if err != nil {
+		return st, err
+	}
+	if len(argv) != 1 {
+		return st, fmt.Errorf("bad status response")
+	}
+	err = json.Unmarshal([]byte(argv[0]), &st)
+	return st, err
+}
+
+// Subscribe to the events from now on, buffering buf of them. table
+// updates wait for subscribers that fall behind, keep reading until cancel.
+// the channel is closed by cancel, or when the resolver went away once
+// every event was read
+func (m *Manager) Subscribe(buf int) (events <-chan Event, cancel func()) {
+	s := &subscriber{c: make(chan Event, buf), done: make(chan bool)}
+
+	m.mu.Lock()
+	m.subs[s] = true
+	m.mu.Unlock()
+
+	return s.c, func() {
+		// unblock a publish waiting for us
+		s.once.Do(func() { close(s.done) })
+
+		m.mu.Lock()
+		delete(m.subs, s)
+		m.mu.Unlock()
+
+		s.close()
+	}
+}
+
+// publish ev to the subscribers, waiting for the slow ones without holding
+// m.mu. must hold m.pubMu
+func (m *Manager) publish(ev Event) {
+	m.mu.Lock()
+	subs := make([]*subscriber, 0, len(m.subs))
+	for s := range m.subs {
+		subs = append(subs, s)
+	}
+	m.mu.Unlock()
+
+	for _, s := range subs {
+		s.send(ev)
+	}
+}
+
+// gone closes the subscriptions once the resolver went away
+func (m *Manager) gone() {
+	m.mu.Lock()
+	subs := m.subs
+	m.subs = make(map[*subscriber]bool)
+	m.mu.Unlock()
+
+	for s := range subs {
+		s.close()
+	}
+	close(m.done)
+}
+
+func (m *Manager) startup(ipc.Args) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = true
+}
+
+// table updates are requests, errors are sent back to the resolver so it can
+// retry them
+
+// updateTable applies a batch of changes to a table, see backend.ParseUpdate
+func (m *Manager) updateTable(args ipc.Args) ([]string, error) {
+	u, err := backend.ParseUpdate(args.Argv)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, u.Apply(m.b, func(op string, ips []string) {
+		m.applied(Event{Op: op, Table: u.Table, IPs: ips, Why: u.Why})
+	})
+}
+
+// applied records a change the backend made and publishes it
+func (m *Manager) applied(ev Event) {
+	m.pubMu.Lock()
+	defer m.pubMu.Unlock()
+
+	m.mu.Lock()
+	set, ok := m.tables[ev.Table]
+	if !ok || ev.Op == backend.OpFlush {
+		set = make(map[string]bool)
+		m.tables[ev.Table] = set
+	}
+	for _, ip := range ev.IPs {
+		if ev.Op == backend.OpAdd {
+			set[ip] = true
+		} else {
+			delete(set, ip)
+		}
+	}
+	m.mu.Unlock()
+
+	m.publish(ev)
+}
+
+// resolveFailed ipc call from the resolver: table, host, outcome, failures
+func (m *Manager) resolveFailed(args ipc.Args) {
+	if len(args.Argv) != 4 {
+		return
+	}
+	fails, _ := strconv.Atoi(args.Argv[3])
+
+	m.pubMu.Lock()
+	defer m.pubMu.Unlock()
+	m.publish(Event{
+		Op:       resolver.EventResolveFailure,
+		Table:    args.Argv[0],
+		Host:     args.Argv[1],
+		Outcome:  args.Argv[2],
+		Failures: fails,
+	})
+}
+
+// resolverLog logs a record the resolver subprocess forwarded
+func resolverLog(args ipc.Args) {
+	err := logging.Replay(args.Argv, slog.String("proc", "resolver"))
+	if err != nil {
+		slog.Warn("resolver log", "err", err)
+	}
+}
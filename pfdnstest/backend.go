@@ -0,0 +1,140 @@
+package pfdnstest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+)
+
+// Call is a change a Backend was asked to make
+type Call struct {
+	Op    string
+	Table string
+	IPs   []string
+	Err   error
+}
+
+// Backend records the changes made to it and keeps the tables they result
+// in, in memory
+type Backend struct {
+	mu     sync.Mutex
+	calls  []Call
+	tables map[string]map[string]bool
+	fail   error
+	// signalled on every call
+	changed chan bool
+}
+
+func NewBackend() *Backend {
+	return &Backend{
+		tables:  make(map[string]map[string]bool),
+		changed: make(chan bool, 1),
+	}
+}
+
+// Fail makes every call fail with err from now on, nil succeeds again
+func (b *Backend) Fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = err
+}
+
+func (b *Backend) Flush(table string) error {
+	return b.record(backend.OpFlush, table, nil)
+}
+
+func (b *Backend) Add(table string, ips []string) error {
+	return b.record(backend.OpAdd, table, ips)
+}
+
+func (b *Backend) Delete(table string, ips []string) error {
+	return b.record(backend.OpDelete, table, ips)
+}
+
+func (b *Backend) record(op string, table string, ips []string) error {
+	b.mu.Lock()
+	defer func() {
+		b.mu.Unlock()
+		select {
+		case b.changed <- true:
+		default:
+		}
+	}()
+
+	c := Call{Op: op, Table: table, IPs: append([]string(nil), ips...), Err: b.fail}
+	b.calls = append(b.calls, c)
+	if b.fail != nil {
+		return b.fail
+	}
+
+	t, ok := b.tables[table]
+	if !ok || op == backend.OpFlush {
+		t = make(map[string]bool)
+		b.tables[table] = t
+	}
+	for _, ip := range ips {
+		if op == backend.OpAdd {
+			t[ip] = true
+		} else {
+			delete(t, ip)
+		}
+	}
+	return nil
+}
+
+// Calls made so far, failed ones too
+func (b *Backend) Calls() []Call {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Call(nil), b.calls...)
+}
+
+// Table returns the sorted ips in table
+func (b *Backend) Table(table string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ips []string
+	for ip := range b.tables[table] {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Wait until cond holds, checked after every call, or timeout. returns
+// whether it held
+func (b *Backend) Wait(timeout time.Duration, cond func(b *Backend) bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for !cond(b) {
+		select {
+		case <-b.changed:
+		case <-deadline.C:
+			return cond(b)
+		}
+	}
+	return true
+}
+
+// WaitTable waits until table holds exactly ips
+func (b *Backend) WaitTable(timeout time.Duration, table string, ips ...string) bool {
+	want := append([]string(nil), ips...)
+	sort.Strings(want)
+
+	return b.Wait(timeout, func(b *Backend) bool {
+		got := b.Table(table)
+		if len(got) != len(want) {
+			return false
+		}
+		for n := range got {
+			if got[n] != want[n] {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,111 @@
+package pfdnstest
+
+import (
+	"sync"
+	"time"
+
+	"git.cadurx.com/pfdns/resolver"
+)
+
+// Clock is a resolver.Clock whose time only moves on Advance
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+func NewClock() *Clock {
+	return &Clock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) NewTimer(d time.Duration) resolver.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &timer{c: c, ch: make(chan time.Time, 1), when: c.now.Add(d), active: true}
+	c.add(t)
+	c.fire(t)
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers that are due
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	// fired and stopped timers are forgotten until they're reset
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		c.fire(t)
+		if t.active {
+			active = append(active, t)
+		} else {
+			t.listed = false
+		}
+	}
+	for n := len(active); n < len(c.timers); n++ {
+		c.timers[n] = nil
+	}
+	c.timers = active
+}
+
+// add t to the timers Advance fires, must hold c.mu
+func (c *Clock) add(t *timer) {
+	if !t.listed {
+		t.listed = true
+		c.timers = append(c.timers, t)
+	}
+}
+
+// fire t if it's due, must hold c.mu
+func (c *Clock) fire(t *timer) {
+	if t.active && !t.when.After(c.now) {
+		t.active = false
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+}
+
+type timer struct {
+	c      *Clock
+	ch     chan time.Time
+	when   time.Time
+	active bool
+	// in c.timers
+	listed bool
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	was := t.active
+	t.when = t.c.now.Add(d)
+	t.active = true
+	t.c.add(t)
+	t.c.fire(t)
+	return was
+}
+
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	was := t.active
+	t.active = false
+	return was
+}
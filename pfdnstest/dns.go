@@ -0,0 +1,137 @@
+package pfdnstest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DNS is an upstream nameserver on a random localhost port whose answers
+// are scripted per host. hosts without an answer get SERVFAIL
+type DNS struct {
+	mu      sync.Mutex
+	answers map[string]answer
+	queries map[string]int
+
+	srv *dns.Server
+}
+
+type answer struct {
+	rcode int
+	ttl   uint32
+	ips   []string
+}
+
+// NewDNS starts a nameserver, Close it when done
+func NewDNS() (*DNS, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DNS{
+		answers: make(map[string]answer),
+		queries: make(map[string]int),
+	}
+
+	started := make(chan bool)
+	d.srv = &dns.Server{
+		PacketConn:        pc,
+		Handler:           d,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() {
+		_ = d.srv.ActivateAndServe()
+	}()
+	<-started
+
+	return d, nil
+}
+
+// Addr the nameserver listens on, host:port
+func (d *DNS) Addr() string {
+	return d.srv.PacketConn.LocalAddr().String()
+}
+
+// ResolvConf is a resolv.conf pointing at d
+func (d *DNS) ResolvConf() string {
+	return fmt.Sprintf("nameserver %s\n", d.Addr())
+}
+
+// Set answers host's A queries with ips and ttl, no ips is NODATA
+func (d *DNS) Set(host string, ttl uint32, ips ...string) {
+	d.set(host, answer{rcode: dns.RcodeSuccess, ttl: ttl, ips: ips})
+}
+
+// SetRcode answers host's queries with rcode, negative answers carry a SOA
+// with ttl
+func (d *DNS) SetRcode(host string, rcode int, ttl uint32) {
+	d.set(host, answer{rcode: rcode, ttl: ttl})
+}
+
+func (d *DNS) set(host string, a answer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.answers[dns.CanonicalName(host)] = a
+}
+
+// Queries how many times host was asked for
+func (d *DNS) Queries(host string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queries[dns.CanonicalName(host)]
+}
+
+func (d *DNS) Close() error {
+	return d.srv.Shutdown()
+}
+
+func (d *DNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		_ = w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+
+	d.mu.Lock()
+	d.queries[name]++
+	a, ok := d.answers[name]
+	d.mu.Unlock()
+
+	switch {
+	case !ok:
+		m.Rcode = dns.RcodeServerFailure
+	case a.rcode != dns.RcodeSuccess:
+		m.Rcode = a.rcode
+		m.Ns = append(m.Ns, soa(name, a.ttl))
+	case len(a.ips) == 0:
+		m.Ns = append(m.Ns, soa(name, a.ttl))
+	case q.Qtype == dns.TypeA:
+		for _, ip := range a.ips {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: a.ttl},
+				A:   net.ParseIP(ip),
+			})
+		}
+	}
+
+	_ = w.WriteMsg(m)
+}
+
+func soa(name string, ttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns." + name,
+		Mbox:   "hostmaster." + name,
+		Serial: 1,
+		Minttl: ttl,
+	}
+}
@@ -0,0 +1,129 @@
+// Package pfdnstest runs a resolver in process for tests: against a
+// scripted nameserver, a Backend recording the table changes instead of
+// pfctl and a Clock that only moves when told to
+package pfdnstest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.cadurx.com/pfdns/pfdns"
+	"git.cadurx.com/pfdns/resolver"
+)
+
+// Harness is a resolver in process, its Manager applies the table updates
+// to Backend
+type Harness struct {
+	*pfdns.Manager
+
+	DNS     *DNS
+	Backend *Backend
+	Clock   *Clock
+
+	cfg resolver.Config
+
+	mu       sync.Mutex
+	failures []Failure
+}
+
+// Failure is a host the resolver failed to resolve
+type Failure struct {
+	Table    string
+	Host     string
+	Outcome  string
+	Failures int
+}
+
+// Start a harness, setup scripts its DNS answers before the resolver asks.
+// config is json, as in pfdns.json
+func Start(config string, setup func(*DNS)) (*Harness, error) {
+	cfg, err := resolver.ParseConfig(strings.NewReader(config))
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := NewDNS()
+	if err != nil {
+		return nil, err
+	}
+	if setup != nil {
+		setup(d)
+	}
+
+	h := &Harness{
+		DNS:     d,
+		Backend: NewBackend(),
+		Clock:   NewClock(),
+		cfg:     cfg,
+	}
+	h.Manager = pfdns.New(h.Backend)
+
+	events, _ := h.Subscribe(100)
+	go h.collect(events)
+
+	err = h.Manager.Start(pfdns.Options{
+		Config:     strings.NewReader(config),
+		ResolvConf: strings.NewReader(d.ResolvConf()),
+		Clock:      h.Clock,
+	})
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// collect the resolve failures until the resolver stops
+func (h *Harness) collect(events <-chan pfdns.Event) {
+	for ev := range events {
+		if ev.Op != resolver.EventResolveFailure {
+			continue
+		}
+
+		h.mu.Lock()
+		h.failures = append(h.failures, Failure{
+			Table:    ev.Table,
+			Host:     ev.Host,
+			Outcome:  ev.Outcome,
+			Failures: ev.Failures,
+		})
+		h.mu.Unlock()
+	}
+}
+
+// Failures the resolver reported so far
+func (h *Harness) Failures() []Failure {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Failure(nil), h.failures...)
+}
+
+// Reload sends the resolver the changes from its config to config, as pfdns
+// does on reload. an error if the change needs a restart
+func (h *Harness) Reload(config string) error {
+	cfg, err := resolver.ParseConfig(strings.NewReader(config))
+	if err != nil {
+		return err
+	}
+
+	changes, restart := resolver.Diff(h.cfg, cfg)
+	if restart {
+		return fmt.Errorf("config change needs a restart")
+	}
+	for _, c := range changes {
+		if err := h.Change(c); err != nil {
+			return err
+		}
+	}
+
+	h.cfg = cfg
+	return nil
+}
+
+// Close stops the resolver and the nameserver
+func (h *Harness) Close() {
+	h.Manager.Close()
+	_ = h.DNS.Close()
+}
@@ -0,0 +1,223 @@
+package pfdnstest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+	"github.com/miekg/dns"
+)
+
+// how long to wait for the resolver in real time
+const timeout = 5 * time.Second
+
+// sends table updates right away and resolves on the exact TTL, so the
+// tests know when things happen
+const base = `"BatchWindow": "0s", "Jitter": 0, "Prefetch": 100, "MinRefresh": "1s"`
+
+func start(t *testing.T, config string, setup func(*DNS)) *Harness {
+	t.Helper()
+
+	h, err := Start(config, setup)
+	if err != nil {
+		t.Fatalf("start: %s", err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// advance moves the clock a second at a time until cond holds, false if it
+// didn't within max
+func advance(h *Harness, max time.Duration, cond func() bool) bool {
+	for passed := time.Duration(0); !cond(); passed += time.Second {
+		if passed >= max {
+			return false
+		}
+		h.Clock.Advance(time.Second)
+		// let the resolver catch up
+		time.Sleep(2 * time.Millisecond)
+	}
+	return true
+}
+
+// tableIs returns whether table holds exactly ips, sorted
+func tableIs(h *Harness, table string, ips ...string) func() bool {
+	return func() bool {
+		got := h.Backend.Table(table)
+		if len(got) != len(ips) {
+			return false
+		}
+		for n := range got {
+			if got[n] != ips[n] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func waitTable(t *testing.T, h *Harness, table string, ips ...string) {
+	t.Helper()
+
+	if !h.Backend.WaitTable(timeout, table, ips...) {
+		t.Fatalf("table %s is %v, want %v", table, h.Backend.Table(table), ips)
+	}
+}
+
+// the last call of op for ip in table, ok false if none
+func lastCall(b *Backend, op string, table string, ip string) (c Call, ok bool) {
+	for _, c := range b.Calls() {
+		if c.Op != op || c.Table != table {
+			continue
+		}
+		for _, got := range c.IPs {
+			if got == ip {
+				return c, true
+			}
+		}
+	}
+	return c, false
+}
+
+func TestAdd(t *testing.T) {
+	h := start(t, `{`+base+`, "Tables": {"t": ["a.test", "192.0.2.9"]}}`, func(d *DNS) {
+		d.Set("a.test", 300, "192.0.2.1", "192.0.2.2")
+	})
+
+	waitTable(t, h, "t", "192.0.2.1", "192.0.2.2", "192.0.2.9")
+
+	calls := h.Backend.Calls()
+	if len(calls) == 0 || calls[0].Op != backend.OpFlush || calls[0].Table != "t" {
+		t.Errorf("first call %+v, want a flush of t", calls)
+	}
+
+	got := h.Tables()["t"]
+	if len(got) != 3 {
+		t.Errorf("Tables() t is %v", got)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	h := start(t, `{`+base+`, "DeleteAfter": "1m", "Tables": {"t": ["a.test"]}}`, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1")
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+
+	// the answer changes, the old ip stays for DeleteAfter
+	h.DNS.Set("a.test", 10, "192.0.2.2")
+	changed := h.Clock.Now()
+	ok := advance(h, 30*time.Second, func() bool {
+		return len(h.Backend.Table("t")) == 2
+	})
+	if !ok {
+		t.Fatalf("new ip not added, table %v", h.Backend.Table("t"))
+	}
+
+	ok = advance(h, 2*time.Minute, func() bool {
+		return len(h.Backend.Table("t")) == 1
+	})
+	if !ok {
+		t.Fatalf("old ip not deleted, table %v", h.Backend.Table("t"))
+	}
+	waitTable(t, h, "t", "192.0.2.2")
+
+	if took := h.Clock.Now().Sub(changed); took < time.Minute {
+		t.Errorf("old ip deleted after %s, before DeleteAfter", took)
+	}
+	c, ok := lastCall(h.Backend, backend.OpDelete, "t", "192.0.2.1")
+	if !ok {
+		t.Fatalf("no delete of 192.0.2.1 in %+v", h.Backend.Calls())
+	}
+	if c.Err != nil {
+		t.Errorf("delete failed: %s", c.Err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	h := start(t, `{`+base+`, "Tables": {"t": ["a.test"], "u": ["192.0.2.9"]}}`, func(d *DNS) {
+		d.Set("a.test", 300, "192.0.2.1")
+		d.Set("b.test", 300, "192.0.2.2")
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+	waitTable(t, h, "u", "192.0.2.9")
+
+	// a.test is swapped for b.test, u is removed and left as it is
+	err := h.Reload(`{` + base + `, "Tables": {"t": ["b.test"]}, "RemovedTables": "keep"}`)
+	if err == nil {
+		t.Fatalf("RemovedTables changed without a restart")
+	}
+	err = h.Reload(`{` + base + `, "Tables": {"t": ["b.test"]}}`)
+	if err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	waitTable(t, h, "t", "192.0.2.2")
+	waitTable(t, h, "u")
+
+	if err := h.AddHost("v", "192.0.2.10"); err != nil {
+		t.Fatalf("add host: %s", err)
+	}
+	waitTable(t, h, "v", "192.0.2.10")
+}
+
+func TestResolveFailure(t *testing.T) {
+	h := start(t, `{`+base+`, "Tables": {"t": ["a.test", "gone.test"]}}`, func(d *DNS) {
+		d.Set("a.test", 300, "192.0.2.1")
+		d.SetRcode("gone.test", dns.RcodeNameError, 60)
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+
+	// failing servers keep the ips we have
+	h.DNS.SetRcode("a.test", dns.RcodeServerFailure, 0)
+	ok := advance(h, 10*time.Minute, func() bool {
+		return len(h.Failures()) > 0
+	})
+	if !ok {
+		t.Fatalf("no failure reported")
+	}
+
+	f := h.Failures()[0]
+	if f.Table != "t" || f.Host != "a.test" || f.Outcome != "servfail" || f.Failures < 1 {
+		t.Errorf("failure %+v", f)
+	}
+	for _, f := range h.Failures() {
+		if f.Host == "gone.test" {
+			t.Errorf("NXDOMAIN reported as a failure: %+v", f)
+		}
+	}
+	waitTable(t, h, "t", "192.0.2.1")
+}
+
+func TestBackendFailure(t *testing.T) {
+	h := start(t, `{`+base+`, "Tables": {"t": ["a.test"]}}`, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1")
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+
+	h.Backend.Fail(errors.New("pf is down"))
+	h.DNS.Set("a.test", 10, "192.0.2.1", "192.0.2.2")
+
+	dirty := func() bool {
+		st, err := h.Status()
+		return err == nil && st.Tables["t"].Dirty
+	}
+	if !advance(h, 30*time.Second, dirty) {
+		t.Fatalf("table not dirty after a failed update")
+	}
+	st, _ := h.Status()
+	if ts := st.Tables["t"]; ts.FailedAdds != 1 || ts.Error == "" || ts.NextRetry.IsZero() {
+		t.Errorf("dirty status %+v", ts)
+	}
+
+	// retried with backoff until the backend is back
+	h.Backend.Fail(nil)
+	ok := advance(h, 5*time.Minute, func() bool {
+		return len(h.Backend.Table("t")) == 2
+	})
+	if !ok {
+		t.Fatalf("failed add not retried, table %v", h.Backend.Table("t"))
+	}
+	if !advance(h, time.Minute, func() bool { return !dirty() }) {
+		t.Errorf("table still dirty after the retry")
+	}
+}
@@ -0,0 +1,129 @@
+package pfdnstest
+
+import (
+	"testing"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+)
+
+const shared = `{` + base + `, "DeleteAfter": "1m", "Tables": {"t": ["a.test", "b.test"]}}`
+
+// an answer that only shrank releases the ips it dropped
+func TestSharedShrink(t *testing.T) {
+	h := start(t, shared, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1", "192.0.2.2")
+		d.Set("b.test", 10, "192.0.2.2")
+	})
+	waitTable(t, h, "t", "192.0.2.1", "192.0.2.2")
+
+	h.DNS.Set("a.test", 10, "192.0.2.2")
+	if !advance(h, 3*time.Minute, tableIs(h, "t", "192.0.2.2")) {
+		t.Fatalf("dropped ip not deleted, table %v", h.Backend.Table("t"))
+	}
+
+	st, err := h.Status()
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if got := st.Tables["t"].Hosts["a.test"].IPs; len(got) != 1 || got[0] != "192.0.2.2" {
+		t.Errorf("status has a.test at %v", got)
+	}
+}
+
+// an ip stays while any host resolves to it
+func TestSharedDrop(t *testing.T) {
+	h := start(t, shared, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1")
+		d.Set("b.test", 10, "192.0.2.1")
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+
+	// b.test still has it
+	h.DNS.Set("a.test", 10, "192.0.2.3")
+	advance(h, 3*time.Minute, func() bool { return false })
+	waitTable(t, h, "t", "192.0.2.1", "192.0.2.3")
+
+	// now nobody does
+	h.DNS.Set("b.test", 10, "192.0.2.4")
+	if !advance(h, 3*time.Minute, tableIs(h, "t", "192.0.2.3", "192.0.2.4")) {
+		t.Fatalf("ip nobody resolves to not deleted, table %v", h.Backend.Table("t"))
+	}
+
+	// removing a host keeps what the other has
+	h.DNS.Set("a.test", 10, "192.0.2.4")
+	if !advance(h, 3*time.Minute, tableIs(h, "t", "192.0.2.4")) {
+		t.Fatalf("a.test's old ip not deleted, table %v", h.Backend.Table("t"))
+	}
+	if err := h.RemoveHost("t", "a.test"); err != nil {
+		t.Fatalf("remove host: %s", err)
+	}
+	advance(h, 3*time.Minute, func() bool { return false })
+	waitTable(t, h, "t", "192.0.2.4")
+}
+
+// an ip one host dropped and another picked up is never deleted, whichever
+// of the delete and the add is handled first
+func TestSharedReclaim(t *testing.T) {
+	for _, host := range []string{"a.test", "b.test"} {
+		t.Run(host, func(t *testing.T) {
+			h := start(t, shared, func(d *DNS) {
+				d.Set("a.test", 10, "192.0.2.1")
+				d.Set("b.test", 10, "192.0.2.2")
+			})
+			waitTable(t, h, "t", "192.0.2.1", "192.0.2.2")
+
+			// a.test drops .1 and it's queued, then host claims it again
+			h.DNS.Set("a.test", 10, "192.0.2.2")
+			pending := func() int {
+				st, err := h.Status()
+				if err != nil {
+					return -1
+				}
+				return st.Tables["t"].Pending
+			}
+			if !advance(h, 30*time.Second, func() bool { return pending() == 1 }) {
+				t.Fatalf("dropped ip not queued, pending %d", pending())
+			}
+			h.DNS.Set(host, 10, "192.0.2.1", "192.0.2.2")
+			if !advance(h, 30*time.Second, func() bool { return pending() == 0 }) {
+				t.Fatalf("reclaimed ip still queued")
+			}
+
+			advance(h, 3*time.Minute, func() bool { return false })
+			waitTable(t, h, "t", "192.0.2.1", "192.0.2.2")
+			if c, ok := lastCall(h.Backend, backend.OpDelete, "t", "192.0.2.1"); ok {
+				t.Errorf("reclaimed ip deleted: %+v", c)
+			}
+		})
+	}
+}
+
+// a host removed between claiming its answer and the add leaves nothing
+// behind that no host owns
+func TestRemovedHostNotAdded(t *testing.T) {
+	h := start(t, `{`+base+`, "DeleteAfter": "0s", "Tables": {"t": ["b.test"]}}`, func(d *DNS) {
+		d.Set("a.test", 300, "192.0.2.1")
+		d.Set("b.test", 300, "192.0.2.2")
+	})
+	waitTable(t, h, "t", "192.0.2.2")
+
+	// removals landing before, during and after a.test's answer
+	for n := 0; n < 50; n++ {
+		if err := h.AddHost("t", "a.test"); err != nil {
+			t.Fatalf("add host: %s", err)
+		}
+		time.Sleep(time.Duration(n*20) * time.Microsecond)
+		if err := h.RemoveHost("t", "a.test"); err != nil {
+			t.Fatalf("remove host: %s", err)
+		}
+	}
+
+	// let a.test's last answers in, and anything they queued
+	time.Sleep(200 * time.Millisecond)
+	advance(h, 10*time.Second, func() bool { return false })
+	time.Sleep(100 * time.Millisecond)
+	if got := h.Backend.Table("t"); len(got) != 1 || got[0] != "192.0.2.2" {
+		t.Errorf("table %v, want only b.test's ip", got)
+	}
+}
@@ -0,0 +1,119 @@
+package pfdnstest
+
+import (
+	"testing"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+)
+
+// an ip waiting in the queue is taken out when its host resolves to it again
+func TestQueueCancel(t *testing.T) {
+	h := start(t, `{`+base+`, "DeleteAfter": "1m", "Tables": {"t": ["a.test"]}}`, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1")
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+
+	h.DNS.Set("a.test", 10, "192.0.2.2")
+	pending := func() int {
+		st, err := h.Status()
+		if err != nil {
+			return -1
+		}
+		return st.Tables["t"].Pending
+	}
+	if !advance(h, 30*time.Second, func() bool { return pending() == 1 }) {
+		t.Fatalf("old ip not queued, pending %d", pending())
+	}
+
+	h.DNS.Set("a.test", 10, "192.0.2.1", "192.0.2.2")
+	if !advance(h, 30*time.Second, func() bool { return pending() == 0 }) {
+		t.Fatalf("re-added ip still queued")
+	}
+
+	// well past DeleteAfter
+	queries := h.DNS.Queries("a.test")
+	advance(h, 3*time.Minute, func() bool { return false })
+	if h.DNS.Queries("a.test") == queries {
+		t.Fatalf("clock didn't move the resolver")
+	}
+	waitTable(t, h, "t", "192.0.2.1", "192.0.2.2")
+	if c, ok := lastCall(h.Backend, backend.OpDelete, "t", "192.0.2.1"); ok {
+		t.Errorf("re-added ip deleted: %+v", c)
+	}
+}
+
+// an ip expiring sooner than what's queued resets the queue's timer
+func TestQueueTimerReset(t *testing.T) {
+	config := `{` + base + `, "MaxRefresh": "10s",
+		"Tables": {"slow": ["a.test"], "fast": ["b.test"]},
+		"TableOptions": {"slow": {"DeleteAfter": "10m"}, "fast": {"DeleteAfter": "1m"}}}`
+	h := start(t, config, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1")
+		d.Set("b.test", 10, "192.0.2.11")
+	})
+	waitTable(t, h, "slow", "192.0.2.1")
+	waitTable(t, h, "fast", "192.0.2.11")
+
+	// slow's ip is queued first, the timer waits for its 10m
+	h.DNS.Set("a.test", 10, "192.0.2.2")
+	if !advance(h, 30*time.Second, func() bool { return len(h.Backend.Table("slow")) == 2 }) {
+		t.Fatalf("slow not updated, %v", h.Backend.Table("slow"))
+	}
+	h.DNS.Set("b.test", 10, "192.0.2.12")
+	if !advance(h, 30*time.Second, func() bool { return len(h.Backend.Table("fast")) == 2 }) {
+		t.Fatalf("fast not updated, %v", h.Backend.Table("fast"))
+	}
+	queued := h.Clock.Now()
+
+	if !advance(h, 3*time.Minute, func() bool { return len(h.Backend.Table("fast")) == 1 }) {
+		t.Fatalf("fast's ip not deleted after its DeleteAfter, %v", h.Backend.Table("fast"))
+	}
+	if took := h.Clock.Now().Sub(queued); took > 2*time.Minute {
+		t.Errorf("fast's ip deleted after %s", took)
+	}
+	waitTable(t, h, "fast", "192.0.2.12")
+	waitTable(t, h, "slow", "192.0.2.1", "192.0.2.2")
+
+	if !advance(h, 12*time.Minute, func() bool { return len(h.Backend.Table("slow")) == 1 }) {
+		t.Fatalf("slow's ip not deleted, %v", h.Backend.Table("slow"))
+	}
+	if took := h.Clock.Now().Sub(queued); took < 9*time.Minute {
+		t.Errorf("slow's ip deleted after %s, before its DeleteAfter", took)
+	}
+	waitTable(t, h, "slow", "192.0.2.2")
+}
+
+// the least recently seen ips are evicted for MaxIPs, the queue counts them
+func TestQueueEvict(t *testing.T) {
+	config := `{` + base + `, "DeleteAfter": "1h", "Tables": {"t": ["a.test"]},
+		"TableOptions": {"t": {"MaxIPs": 2}}}`
+	h := start(t, config, func(d *DNS) {
+		d.Set("a.test", 10, "192.0.2.1")
+	})
+	waitTable(t, h, "t", "192.0.2.1")
+
+	h.DNS.Set("a.test", 10, "192.0.2.2")
+	if !advance(h, 30*time.Second, func() bool { return len(h.Backend.Table("t")) == 2 }) {
+		t.Fatalf("not updated, %v", h.Backend.Table("t"))
+	}
+
+	// .1 waits for DeleteAfter, room for .2 and .3 only
+	h.DNS.Set("a.test", 10, "192.0.2.3")
+	ok := advance(h, 30*time.Second, func() bool {
+		got := h.Backend.Table("t")
+		return len(got) == 2 && got[1] == "192.0.2.3"
+	})
+	if !ok {
+		t.Fatalf("table %v, want .2 and .3", h.Backend.Table("t"))
+	}
+	waitTable(t, h, "t", "192.0.2.2", "192.0.2.3")
+
+	st, err := h.Status()
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if ts := st.Tables["t"]; ts.Evicted != 1 || ts.Pending != 1 || ts.IPs != 1 {
+		t.Errorf("status %+v, want 1 evicted, 1 pending, 1 claimed", ts)
+	}
+}
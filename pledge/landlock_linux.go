@@ -0,0 +1,118 @@
+package pledge
+
+import (
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	landlockRead   = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockWrite  = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	landlockExec   = unix.LANDLOCK_ACCESS_FS_EXECUTE
+	landlockCreate = unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_REFER
+
+	// the only rights a rule on a file (not a directory) may have
+	landlockFile = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// the ruleset unveil builds up, -1 until the first unveil
+var ruleset = -1
+
+// handled rights of the ruleset, what the kernel's landlock abi knows about
+var handled uint64
+
+// landlockAdd allows path with unveil permissions, "" allows nothing but
+// still hides everything else once restricted
+func landlockAdd(path string, permissions string) error {
+	if ruleset < 0 {
+		err := landlockInit()
+		if err != nil {
+			return err
+		}
+	}
+
+	var access uint64
+	for p, a := range map[string]uint64{"r": landlockRead, "w": landlockWrite, "x": landlockExec, "c": landlockCreate} {
+		if strings.Contains(permissions, p) {
+			access |= a
+		}
+	}
+	access &= handled
+	if access == 0 {
+		return nil
+	}
+
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFile
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func landlockInit() error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+		return ErrUnsupported
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	// abi 1 has everything up to make_sym, 2 adds refer, 3 truncate
+	handled = landlockRead | landlockWrite | landlockExec | landlockCreate
+	if abi < 3 {
+		handled &^= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi < 2 {
+		handled &^= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	ruleset = int(fd)
+	return nil
+}
+
+// landlockRestrict applies the ruleset to every thread, nothing to do if
+// nothing was unveiled
+func landlockRestrict() error {
+	if ruleset < 0 {
+		return nil
+	}
+	defer func() {
+		unix.Close(ruleset)
+		ruleset = -1
+	}()
+
+	err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if err != nil {
+		return err
+	}
+	return allThreads(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0)
+}
@@ -1,5 +1,38 @@
 package pledge
 
-func Pledge(promises string, paths []string) (err error) {
-	return pledge(promises, paths)
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnsupported returned on systems without the mechanism
+var ErrUnsupported = errors.New("unsupported on this OS")
+
+// ErrCgo returned by UnveilBlock on linux when the binary links cgo (os/user
+// and net do by default): the runtime can't apply landlock to every thread
+// then. build with CGO_ENABLED=0, or -tags osusergo,netgo
+var ErrCgo = errors.New("landlock needs a build without cgo (CGO_ENABLED=0 or -tags osusergo,netgo)")
+
+// Pledge restricts the process to promises, see pledge(2). execpromises are
+// the promises programs we exec start with, "" leaves them unrestricted
+func Pledge(promises string, execpromises string) error {
+	return pledge(promises, execpromises)
+}
+
+// Unveil allows access to path with permissions ("rwxc"), once called
+// everything not unveiled is hidden, see unveil(2)
+func Unveil(path string, permissions string) error {
+	return unveil(path, permissions)
+}
+
+// UnveilBlock no more paths may be unveiled
+func UnveilBlock() error {
+	return unveilBlock()
+}
+
+// LimitFile restricts an open file to reading ("r") and/or writing ("w"),
+// with Capsicum rights on FreeBSD. only that file: the process doesn't enter
+// capability mode and can still open any other file or socket
+func LimitFile(f *os.File, permissions string) error {
+	return limitFile(f, permissions)
 }
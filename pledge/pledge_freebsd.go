@@ -1,7 +1,40 @@
 package pledge
 
-import "fmt"
+import (
+	"os"
+	"strings"
 
-func pledge(p string, paths []string) {
-	return fmt.Error("unimplemented")
+	"golang.org/x/sys/unix"
+)
+
+func pledge(promises string, execpromises string) error {
+	return ErrUnsupported
+}
+
+func unveil(path string, permissions string) error {
+	return ErrUnsupported
+}
+
+func unveilBlock() error {
+	return ErrUnsupported
+}
+
+// limitFile with cap_rights_limit(2), the runtime poller needs event and
+// fcntl on top of read/write. we don't cap_enter(2): the resolver sends to
+// nameservers by address, which capability mode forbids, so this only keeps
+// the pipes to the parent from being used for anything else
+func limitFile(f *os.File, permissions string) error {
+	rights := []uint64{unix.CAP_EVENT, unix.CAP_FCNTL, unix.CAP_FSTAT}
+	if strings.Contains(permissions, "r") {
+		rights = append(rights, unix.CAP_READ)
+	}
+	if strings.Contains(permissions, "w") {
+		rights = append(rights, unix.CAP_WRITE)
+	}
+
+	r, err := unix.CapRightsInit(rights)
+	if err != nil {
+		return err
+	}
+	return unix.CapRightsLimit(f.Fd(), r)
 }
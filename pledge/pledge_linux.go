@@ -1,7 +1,58 @@
 package pledge
 
-import "fmt"
+import (
+	"os"
+	"strings"
+	"syscall"
 
-func pledge(p string, paths []string) error {
-	return fmt.Errorf("unimplemented")
+	"golang.org/x/sys/unix"
+)
+
+// pledge with a seccomp filter, allowing the syscalls of promises and
+// returning EPERM for anything else. filters are inherited across exec, so
+// only execpromises equal to promises can be honored
+func pledge(promises string, execpromises string) error {
+	if len(execpromises) > 0 && execpromises != promises {
+		return ErrUnsupported
+	}
+
+	allow, err := syscalls(strings.Fields(promises))
+	if err != nil {
+		return err
+	}
+
+	// a filter needs no_new_privs, tsync sets it on the other threads
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return err
+	}
+	return seccomp(allow)
+}
+
+// unveil with a landlock ruleset, applied by unveilBlock
+func unveil(path string, permissions string) error {
+	return landlockAdd(path, permissions)
+}
+
+func unveilBlock() error {
+	return landlockRestrict()
+}
+
+func limitFile(f *os.File, permissions string) error {
+	return ErrUnsupported
+}
+
+// allThreads runs a per thread syscall on every thread, the runtime only
+// supports this without cgo
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		// the os supports it, our build doesn't
+		return ErrCgo
+	default:
+		return errno
+	}
 }
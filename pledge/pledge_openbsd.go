@@ -1,15 +1,26 @@
 package pledge
 
 import (
-	"syscall"
-	"unsafe"
+	"os"
+
+	"golang.org/x/sys/unix"
 )
 
-func pledge(promises string, paths []string) (err error) {
-	promise, err := syscall.BytePtrFromString(promises)
-	if err != nil {
-		return err
+func pledge(promises string, execpromises string) error {
+	if len(execpromises) == 0 {
+		return unix.PledgePromises(promises)
 	}
-	_, _, e := syscall.Syscall(108, uintptr(unsafe.Pointer(promise)), uintptr(unsafe.Pointer(nil)), 0)
-	return e
+	return unix.Pledge(promises, execpromises)
+}
+
+func unveil(path string, permissions string) error {
+	return unix.Unveil(path, permissions)
+}
+
+func unveilBlock() error {
+	return unix.UnveilBlock()
+}
+
+func limitFile(f *os.File, permissions string) error {
+	return ErrUnsupported
 }
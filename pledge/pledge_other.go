@@ -0,0 +1,22 @@
+//go:build !openbsd && !freebsd && !linux
+// +build !openbsd,!freebsd,!linux
+
+package pledge
+
+import "os"
+
+func pledge(promises string, execpromises string) error {
+	return ErrUnsupported
+}
+
+func unveil(path string, permissions string) error {
+	return ErrUnsupported
+}
+
+func unveilBlock() error {
+	return ErrUnsupported
+}
+
+func limitFile(f *os.File, permissions string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,124 @@
+package pledge
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompSetModeFilter = 1
+	seccompFlagTsync     = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// syscalls of each promise, the go runtime's are in stdio. arch specific
+// ones are in archSyscalls, only syscalls every linux arch has go here or
+// the arches without tables don't build
+var promiseSyscalls = map[string][]uintptr{
+	"stdio": {
+		unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV,
+		unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_CLOSE, unix.SYS_FSTAT,
+		unix.SYS_LSEEK, unix.SYS_FCNTL, unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_PIPE2,
+		unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MADVISE, unix.SYS_BRK,
+		unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN,
+		unix.SYS_SIGALTSTACK, unix.SYS_TGKILL, unix.SYS_GETPID, unix.SYS_GETTID,
+		unix.SYS_GETPPID, unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+		unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_FUTEX, unix.SYS_SET_ROBUST_LIST, unix.SYS_RSEQ,
+		unix.SYS_SCHED_YIELD, unix.SYS_SCHED_GETAFFINITY, unix.SYS_NANOSLEEP,
+		unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_GETTIMEOFDAY,
+		unix.SYS_SETITIMER, unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE,
+		unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EVENTFD2,
+		unix.SYS_GETRANDOM, unix.SYS_PRLIMIT64, unix.SYS_UNAME, unix.SYS_RESTART_SYSCALL,
+		unix.SYS_EXIT, unix.SYS_EXIT_GROUP,
+	},
+	"inet": {
+		unix.SYS_SOCKET, unix.SYS_CONNECT, unix.SYS_BIND, unix.SYS_GETSOCKNAME,
+		unix.SYS_GETPEERNAME, unix.SYS_GETSOCKOPT, unix.SYS_SETSOCKOPT,
+		unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG,
+		unix.SYS_SHUTDOWN,
+	},
+	// udp and tcp to nameservers, same as inet
+	"dns": {
+		unix.SYS_SOCKET, unix.SYS_CONNECT, unix.SYS_BIND, unix.SYS_GETSOCKNAME,
+		unix.SYS_GETPEERNAME, unix.SYS_GETSOCKOPT, unix.SYS_SETSOCKOPT,
+		unix.SYS_SENDTO, unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG,
+	},
+}
+
+// syscalls returns the sorted, unique syscalls of promises
+func syscalls(promises []string) ([]uintptr, error) {
+	if auditArch == 0 {
+		return nil, ErrUnsupported
+	}
+
+	set := map[uintptr]bool{}
+	for _, p := range promises {
+		nrs, ok := promiseSyscalls[p]
+		if !ok {
+			return nil, fmt.Errorf("promise %q not supported", p)
+		}
+		for _, nr := range append(nrs, archSyscalls[p]...) {
+			set[nr] = true
+		}
+	}
+
+	var allow []uintptr
+	for nr := range set {
+		allow = append(allow, nr)
+	}
+	sort.Slice(allow, func(i, j int) bool { return allow[i] < allow[j] })
+	return allow, nil
+}
+
+// seccomp installs a filter on every thread that kills us if we're not
+// running as auditArch and returns EPERM for syscalls not in allow
+func seccomp(allow []uintptr) error {
+	// jumps are 8 bit
+	if len(allow) > 250 {
+		return fmt.Errorf("too many syscalls: %d", len(allow))
+	}
+
+	prog := []unix.SockFilter{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+	}
+	for n, nr := range allow {
+		// jump over the rest of the list and the EPERM
+		prog = append(prog, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), uint8(len(allow)-n), 0))
+	}
+	prog = append(prog,
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+	)
+
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return errno
+	}
+	// tsync returns the thread it couldn't sync
+	if r != 0 {
+		return fmt.Errorf("seccomp: could not sync thread %d", r)
+	}
+	return nil
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
@@ -0,0 +1,11 @@
+package pledge
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+// syscalls amd64 has and arm64 replaced with newer ones, and mmap, arm
+// only has mmap2
+var archSyscalls = map[string][]uintptr{
+	"stdio": {unix.SYS_MMAP, unix.SYS_ARCH_PRCTL, unix.SYS_NEWFSTATAT, unix.SYS_EPOLL_WAIT, unix.SYS_POLL},
+}
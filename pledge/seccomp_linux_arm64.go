@@ -0,0 +1,9 @@
+package pledge
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_AARCH64
+
+var archSyscalls = map[string][]uintptr{
+	"stdio": {unix.SYS_MMAP, unix.SYS_FSTATAT},
+}
@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package pledge
+
+// no syscall tables for this arch, pledge is unsupported
+const auditArch = 0
+
+var archSyscalls map[string][]uintptr
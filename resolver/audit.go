@@ -0,0 +1,40 @@
+package resolver
+
+import (
+	"strconv"
+	"strings"
+)
+
+// why a table changed, sent along with each change so the parent can write
+// it to its audit log once the change is applied
+const (
+	// a host resolved to the ip
+	reasonAnswer = "answer"
+	// a host in the config is an ip
+	reasonStatic = "static"
+	// no host resolved to the ip for DeleteAfter
+	reasonExpiry = "expiry"
+	// the host stopped existing, see NXDomainRemove
+	reasonNXDomain = "nxdomain"
+	// the host or table was removed from the config
+	reasonRemoved = "removed"
+	// the table was over its MaxIPs
+	reasonEvicted = "evicted"
+	// re-applying a change the parent failed to apply
+	reasonReconcile = "reconcile"
+	// a table we start managing is flushed
+	reasonInit = "init"
+)
+
+type why struct {
+	reason string
+	host   string
+	server string
+	ttl    int64
+}
+
+// encode appends w to a change ("flush", "+ip" or "-ip") as tab separated
+// reason, host, server and ttl
+func (w why) encode(change string) string {
+	return strings.Join([]string{change, w.reason, w.host, w.server, strconv.FormatInt(w.ttl, 10)}, "\t")
+}
@@ -5,32 +5,231 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"regexp"
+	"time"
 )
 
-// {"Tables": {"pf_table": ["hostname1", "hostname2"...]}}
-type config struct {
-	Tables      map[string][]string
-	Flush       uint32
-	Verbose     uint8
+// Config {"Tables": {"pf_table": ["hostname1", "hostname2"...]}}
+type Config struct {
+	Tables  map[string][]string
+	Flush   uint32
+	Verbose uint8
+	// how long to keep an ip once no host resolves to it, default 1m. "0s"
+	// removes it right away
 	DeleteAfter string
+
+	// what to do with a table removed from the config:
+	// "delete" (default) removes the IPs we added, "flush" flushes the whole
+	// table, "keep" leaves it as is
+	RemovedTables string
+
+	// per table overrides, keyed by table name
+	TableOptions map[string]TableOptions
+
+	// bounds on how often hosts are re-resolved regardless of the TTL,
+	// both > 0, defaults 5s and 10m
+	MinRefresh string
+	MaxRefresh string
+	// re-resolve at this percent of the TTL so the table is updated before
+	// the old answer expires, default 90
+	Prefetch *int
+	// re-resolve up to this percent earlier at random, default 10
+	Jitter *int
+
+	// remove a host's ips after this many NXDOMAIN answers in a row, default
+	// 0 keeps them until the host resolves again
+	NXDomainRemove int
+
+	// per host overrides of the refresh settings, keyed by hostname
+	HostOptions map[string]HostOptions
+
+	// table changes are collected for BatchWindow and sent to pf as one
+	// update per table of at most MaxBatch ips. defaults 100ms and 500
+	BatchWindow string
+	MaxBatch    int
+
+	// what the parent does with the tables when it exits: "keep" (default)
+	// leaves them as they are, "flush" flushes them, "static" flushes them
+	// and adds SafeTables
+	OnExit     string
+	SafeTables map[string][]string
+
+	// thresholds of the parent's health endpoint
+	Health HealthOptions
+
+	// commands or webhooks the parent runs on table changes
+	Hooks []Hook
+}
+
+// OnExit options
+const (
+	OnExitKeep   = "keep"
+	OnExitFlush  = "flush"
+	OnExitStatic = "static"
+)
+
+// TableOptions per table retention policy
+type TableOptions struct {
+	// how long to keep an ip once no host resolves to it, overrides the
+	// global DeleteAfter. "0s" removes it right away, "6h" keeps anything
+	// seen in the last 6 hours, same as the global one
+	DeleteAfter string
+
+	// maximum number of ips in the table, once reached the least recently
+	// seen ips waiting for DeleteAfter are evicted. 0 is unlimited
+	MaxIPs int
+
+	// what the parent does with pf states of ips deleted from the table:
+	// "keep" (default) leaves them, "kill" kills states from and to them so
+	// established connections are cut off, "report" only logs the states
+	// that would be killed. with -dry "kill" reports like "report"
+	KillStates string
 }
 
-func parseConfig(r io.Reader) (config, error) {
+// KillStates options
+const (
+	KillStatesKeep   = "keep"
+	KillStatesKill   = "kill"
+	KillStatesReport = "report"
+)
+
+// RemovedTables options
+const (
+	RemovedDelete = "delete"
+	RemovedFlush  = "flush"
+	RemovedKeep   = "keep"
+)
+
+// ParseConfig reads a json config, // comments are allowed
+func ParseConfig(r io.Reader) (Config, error) {
 	blob, err := ioutil.ReadAll(r)
 	if err != nil {
-		return config{}, err
+		return Config{}, err
 	}
 
-	// poor mans stripping of comments
-	var re = regexp.MustCompile("//.*\n")
-	blob = re.ReplaceAll(blob, []byte(""))
+	// poor mans stripping of comments, they start a line or follow
+	// whitespace so urls in hooks survive
+	var re = regexp.MustCompile(`(?m)(^|[ \t])//.*$`)
+	blob = re.ReplaceAll(blob, []byte("$1"))
 
-	j := config{}
+	j := Config{}
 	err = json.Unmarshal(blob, &j)
 	if err != nil {
 		return j, fmt.Errorf("bad json in config: %s", err)
 	}
 
+	switch j.RemovedTables {
+	case "", RemovedDelete, RemovedFlush, RemovedKeep:
+	default:
+		return j, fmt.Errorf("bad RemovedTables %q in config", j.RemovedTables)
+	}
+
+	if err := checkDeleteAfter(j.DeleteAfter); err != nil {
+		return j, fmt.Errorf("bad DeleteAfter: %s", err)
+	}
+	for table, opts := range j.TableOptions {
+		if err := checkDeleteAfter(opts.DeleteAfter); err != nil {
+			return j, fmt.Errorf("bad DeleteAfter for table %s: %s", table, err)
+		}
+		if opts.MaxIPs < 0 {
+			return j, fmt.Errorf("bad MaxIPs for table %s: %d", table, opts.MaxIPs)
+		}
+		switch opts.KillStates {
+		case "", KillStatesKeep, KillStatesKill, KillStatesReport:
+		default:
+			return j, fmt.Errorf("bad KillStates %q for table %s", opts.KillStates, table)
+		}
+	}
+
+	if err := j.checkRefresh(""); err != nil {
+		return j, fmt.Errorf("bad refresh settings: %s", err)
+	}
+	for host := range j.HostOptions {
+		if err := j.checkRefresh(host); err != nil {
+			return j, fmt.Errorf("bad refresh settings for %s: %s", host, err)
+		}
+	}
+
+	switch j.OnExit {
+	case "", OnExitKeep, OnExitFlush, OnExitStatic:
+	default:
+		return j, fmt.Errorf("bad OnExit %q in config", j.OnExit)
+	}
+	for table, ips := range j.SafeTables {
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				if _, _, err := net.ParseCIDR(ip); err != nil {
+					return j, fmt.Errorf("bad SafeTables ip %q for table %s", ip, table)
+				}
+			}
+		}
+	}
+
+	for n, hook := range j.Hooks {
+		if err := hook.check(); err != nil {
+			return j, fmt.Errorf("bad Hooks[%d]: %s", n, err)
+		}
+	}
+
+	if err := j.Health.check(); err != nil {
+		return j, fmt.Errorf("bad Health: %s", err)
+	}
+
+	if len(j.BatchWindow) > 0 {
+		if _, err := time.ParseDuration(j.BatchWindow); err != nil {
+			return j, fmt.Errorf("bad BatchWindow: %s", err)
+		}
+	}
+	if j.MaxBatch < 0 {
+		return j, fmt.Errorf("bad MaxBatch: %d", j.MaxBatch)
+	}
+
 	return j, nil
 }
+
+func (c Config) batchWindow() time.Duration {
+	if len(c.BatchWindow) == 0 {
+		return defaultBatchWindow
+	}
+	// checked in ParseConfig
+	d, _ := time.ParseDuration(c.BatchWindow)
+	return d
+}
+
+func (c Config) maxBatch() int {
+	if c.MaxBatch == 0 {
+		return defaultMaxBatch
+	}
+	return c.MaxBatch
+}
+
+// checkDeleteAfter d is empty or a duration >= 0
+func checkDeleteAfter(d string) error {
+	if len(d) == 0 {
+		return nil
+	}
+	v, err := time.ParseDuration(d)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("%s < 0", d)
+	}
+	return nil
+}
+
+// deleteAfter how long to keep ips in table once no host resolves to them
+func (c Config) deleteAfter(table string) time.Duration {
+	d := c.DeleteAfter
+	if opts, ok := c.TableOptions[table]; ok && len(opts.DeleteAfter) > 0 {
+		d = opts.DeleteAfter
+	}
+	if len(d) == 0 {
+		return defaultDeleteAfter
+	}
+
+	// checked in ParseConfig, "0s" is right away for both
+	expDur, _ := time.ParseDuration(d)
+	return expDur
+}
@@ -0,0 +1,64 @@
+package resolver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigRefresh(t *testing.T) {
+	tests := []struct {
+		config string
+		ok     bool
+	}{
+		{`{"MinRefresh": "1s", "MaxRefresh": "1m"}`, true},
+		{`{"MinRefresh": "0s"}`, false},
+		{`{"MinRefresh": "-1s"}`, false},
+		{`{"MaxRefresh": "0s"}`, false},
+		{`{"HostOptions": {"a.test": {"MinRefresh": "0s"}}}`, false},
+		{`{"MinRefresh": "1m", "MaxRefresh": "1s"}`, false},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseConfig(strings.NewReader(tt.config))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err %v", tt.config, err)
+		}
+	}
+}
+
+func TestDeleteAfter(t *testing.T) {
+	tests := []struct {
+		config string
+		// for table t, -1 is a bad config
+		want time.Duration
+	}{
+		{`{}`, defaultDeleteAfter},
+		{`{"DeleteAfter": "0s"}`, 0},
+		{`{"DeleteAfter": "1h"}`, time.Hour},
+		{`{"TableOptions": {"t": {"DeleteAfter": "0s"}}}`, 0},
+		{`{"DeleteAfter": "1h", "TableOptions": {"t": {"DeleteAfter": "0s"}}}`, 0},
+		{`{"DeleteAfter": "0s", "TableOptions": {"t": {"DeleteAfter": "1h"}}}`, time.Hour},
+		{`{"DeleteAfter": "1h", "TableOptions": {"u": {"DeleteAfter": "0s"}}}`, time.Hour},
+		{`{"DeleteAfter": "-1s"}`, -1},
+		{`{"DeleteAfter": "soon"}`, -1},
+		{`{"TableOptions": {"t": {"DeleteAfter": "-1s"}}}`, -1},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ParseConfig(strings.NewReader(tt.config))
+		if tt.want < 0 {
+			if err == nil {
+				t.Errorf("%s: accepted", tt.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.config, err)
+			continue
+		}
+		if got := cfg.deleteAfter("t"); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.config, got, tt.want)
+		}
+	}
+}
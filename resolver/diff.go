@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Change ops sent from the parent to a running resolver on reload
+const (
+	AddTable = "addTable"
+	DelTable = "delTable"
+	AddHost  = "addHost"
+	DelHost  = "delHost"
+)
+
+// Change a single table or host difference between two configs
+type Change struct {
+	Op    string
+	Table string
+	Host  string
+}
+
+// Diff returns the changes needed to go from old to cur. restart is true if
+// something other than the table contents changed and the resolver needs to
+// be restarted to pick it up
+func Diff(old Config, cur Config) (changes []Change, restart bool) {
+	// anything but Tables changed? the parent handles OnExit, Health and
+	// Hooks itself
+	o, c := old, cur
+	o.Tables, c.Tables = nil, nil
+	o.OnExit, c.OnExit = "", ""
+	o.SafeTables, c.SafeTables = nil, nil
+	o.Health, c.Health = HealthOptions{}, HealthOptions{}
+	o.Hooks, c.Hooks = nil, nil
+	if !reflect.DeepEqual(o, c) {
+		return nil, true
+	}
+
+	// removed tables and hosts first, so a host moving between tables is
+	// stopped before it is started again
+	for _, table := range sortedTables(old) {
+		hosts, ok := cur.Tables[table]
+		if !ok {
+			changes = append(changes, Change{Op: DelTable, Table: table})
+			continue
+		}
+
+		keep := iPlist(hosts)
+		for _, host := range old.Tables[table] {
+			if !keep.contains(host) {
+				changes = append(changes, Change{Op: DelHost, Table: table, Host: host})
+			}
+		}
+	}
+
+	for _, table := range sortedTables(cur) {
+		hosts, ok := old.Tables[table]
+		if !ok {
+			changes = append(changes, Change{Op: AddTable, Table: table})
+		}
+
+		had := iPlist(hosts)
+		for _, host := range cur.Tables[table] {
+			if !had.contains(host) {
+				changes = append(changes, Change{Op: AddHost, Table: table, Host: host})
+			}
+		}
+	}
+
+	return changes, false
+}
+
+func sortedTables(cfg Config) []string {
+	var tables []string
+	for table := range cfg.Tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
@@ -0,0 +1,58 @@
+package resolver
+
+import (
+	"fmt"
+	"time"
+)
+
+// health defaults
+const (
+	defaultDegradedFailing = 1
+	defaultDegradedStale   = time.Hour
+)
+
+// HealthOptions when the parent's health endpoint reports DEGRADED or FAIL
+// instead of OK
+type HealthOptions struct {
+	// this many hosts failing to resolve, defaults 1 and 0 (never FAIL)
+	DegradedFailing int
+	FailFailing     int
+
+	// a table's oldest answer is this old, defaults 1h and "" (never FAIL)
+	DegradedStale string
+	FailStale     string
+}
+
+func (h HealthOptions) check() error {
+	if h.DegradedFailing < 0 || h.FailFailing < 0 {
+		return fmt.Errorf("negative failing threshold")
+	}
+	for _, s := range []string{h.DegradedStale, h.FailStale} {
+		if len(s) > 0 {
+			if _, err := time.ParseDuration(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Failing thresholds, 0 is never
+func (h HealthOptions) Failing() (degraded int, fail int) {
+	degraded = h.DegradedFailing
+	if degraded == 0 {
+		degraded = defaultDegradedFailing
+	}
+	return degraded, h.FailFailing
+}
+
+// Stale thresholds, 0 is never
+func (h HealthOptions) Stale() (degraded time.Duration, fail time.Duration) {
+	// checked in ParseConfig
+	degraded, _ = time.ParseDuration(h.DegradedStale)
+	if len(h.DegradedStale) == 0 {
+		degraded = defaultDegradedStale
+	}
+	fail, _ = time.ParseDuration(h.FailStale)
+	return degraded, fail
+}
@@ -0,0 +1,122 @@
+package resolver
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+)
+
+// hook events, fired by the parent once the backend applied a change or
+// when the resolver tells it a host failed to resolve
+const (
+	EventAdd            = backend.OpAdd
+	EventDelete         = backend.OpDelete
+	EventFlush          = backend.OpFlush
+	EventResolveFailure = "resolve-failure"
+)
+
+// ResolveFailed is the ipc call the resolver makes when a host fails to
+// resolve: table, host, outcome and consecutive failures
+const ResolveFailed = "resolveFailed"
+
+// hook defaults
+const (
+	DefaultHookTimeout = 10 * time.Second
+	DefaultHookQueue   = 100
+)
+
+// Hook runs Command, or POSTs to URL, on events. the event is passed as json
+// on stdin or in the body, and to commands in PFDNS_* environment variables
+type Hook struct {
+	// "add", "delete", "flush" and "resolve-failure", empty is all of them
+	Events []string
+	// only events for these tables or hosts, empty is any
+	Tables []string
+	Hosts  []string
+
+	// the program and its arguments, must be an absolute path. on OpenBSD
+	// only commands in the config we started with are unveiled
+	Command []string
+	// a local http url
+	URL string
+
+	// default 10s
+	Timeout string
+	// events waiting for this hook, more are dropped. default 100
+	Queue int
+}
+
+func (h Hook) check() error {
+	for _, e := range h.Events {
+		switch e {
+		case EventAdd, EventDelete, EventFlush, EventResolveFailure:
+		default:
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	switch {
+	case len(h.Command) > 0 && len(h.URL) > 0:
+		return fmt.Errorf("both Command and URL")
+	case len(h.Command) > 0:
+		if len(h.Command[0]) == 0 || h.Command[0][0] != '/' {
+			return fmt.Errorf("command %q is not an absolute path", h.Command[0])
+		}
+	case len(h.URL) > 0:
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url %q is not http", h.URL)
+		}
+	default:
+		return fmt.Errorf("no Command or URL")
+	}
+
+	if len(h.Timeout) > 0 {
+		if _, err := time.ParseDuration(h.Timeout); err != nil {
+			return err
+		}
+	}
+	if h.Queue < 0 {
+		return fmt.Errorf("negative Queue")
+	}
+	return nil
+}
+
+// TimeoutDuration how long the hook may run
+func (h Hook) TimeoutDuration() time.Duration {
+	// checked in ParseConfig
+	d, _ := time.ParseDuration(h.Timeout)
+	if d == 0 {
+		d = DefaultHookTimeout
+	}
+	return d
+}
+
+// QueueSize how many events may wait for the hook
+func (h Hook) QueueSize() int {
+	if h.Queue == 0 {
+		return DefaultHookQueue
+	}
+	return h.Queue
+}
+
+// Wants is the event for a table and host one the hook runs for
+func (h Hook) Wants(event string, table string, host string) bool {
+	match := func(list []string, s string) bool {
+		if len(list) == 0 {
+			return true
+		}
+		for _, l := range list {
+			if l == s {
+				return true
+			}
+		}
+		return false
+	}
+	return match(h.Events, event) && match(h.Tables, table) && match(h.Hosts, host)
+}
@@ -0,0 +1,254 @@
+package resolver
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"git.cadurx.com/pfdns/ipc"
+)
+
+// hosts tracks the running resolve() goroutines so the parent can start and
+// stop individual hosts on reload without restarting us
+type hosts struct {
+	mu     sync.Mutex
+	tables map[string]map[string]*runningHost
+	owners owners
+
+	w      *pfWriter
+	q      *deleteQueue
+	add    chan updateArgs
+	del    chan updateArgs
+	dnscfg resolvConf
+	cfg    Config
+	clock  Clock
+}
+
+// a resolve() goroutine and the ips it has put in its table
+type runningHost struct {
+	quit  chan bool
+	ips   iPlist
+	stats *hostStats
+}
+
+func newHosts(dnscfg resolvConf, cfg Config, add chan updateArgs, del chan updateArgs, clock Clock) *hosts {
+	return &hosts{
+		tables: make(map[string]map[string]*runningHost),
+		owners: make(owners),
+		add:    add,
+		del:    del,
+		dnscfg: dnscfg,
+		cfg:    cfg,
+		clock:  clock,
+	}
+}
+
+// register our handlers for the parents reload messages
+func (h *hosts) ipcInit(i *ipc.IPC) {
+	i.RegisterRequest("getStatus", h.statusRequest)
+	i.Register(AddTable, func(args ipc.Args) {
+		if len(args.Argv) == 1 {
+			h.addTable(args.Argv[0])
+		}
+	})
+	i.Register(DelTable, func(args ipc.Args) {
+		if len(args.Argv) == 1 {
+			h.delTable(args.Argv[0])
+		}
+	})
+	i.Register(AddHost, func(args ipc.Args) {
+		if len(args.Argv) == 2 {
+			h.addHost(args.Argv[0], args.Argv[1])
+		}
+	})
+	i.Register(DelHost, func(args ipc.Args) {
+		if len(args.Argv) == 2 {
+			h.delHost(args.Argv[0], args.Argv[1])
+		}
+	})
+}
+
+func (h *hosts) addTable(table string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.tables[table]; ok {
+		return
+	}
+	h.tables[table] = make(map[string]*runningHost)
+
+	slog.Debug("add table", "table", table)
+
+	//if *noFlush == false {
+	h.w.flush(table, why{reason: reasonInit})
+	//}
+}
+
+// stop every host, the delete queue and the table writer, once the parent
+// of a resolver running in process went away
+func (h *hosts) stop() {
+	h.mu.Lock()
+	for _, running := range h.tables {
+		for _, rh := range running {
+			close(rh.quit)
+		}
+	}
+	h.tables = make(map[string]map[string]*runningHost)
+	h.mu.Unlock()
+
+	// an update without ips stops the queue
+	h.add <- updateArgs{}
+	h.del <- updateArgs{}
+	h.w.stop()
+}
+
+func (h *hosts) delTable(table string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	running, ok := h.tables[table]
+	if !ok {
+		return
+	}
+
+	slog.Debug("del table", "table", table)
+
+	for _, rh := range running {
+		close(rh.quit)
+	}
+	owned := h.owners.ips(table)
+	delete(h.owners, table)
+	delete(h.tables, table)
+
+	switch h.cfg.RemovedTables {
+	case RemovedKeep:
+	case RemovedFlush:
+		h.w.flush(table, why{reason: reasonRemoved})
+	default:
+		if len(owned) > 0 {
+			slog.Info("del ips, table removed", "table", table, "ips", owned)
+			h.w.del(table, owned, why{reason: reasonRemoved})
+		}
+	}
+}
+
+func (h *hosts) addHost(table string, host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	running, ok := h.tables[table]
+	if !ok {
+		slog.Warn("add host: no such table", "table", table, "host", host)
+		return
+	}
+	if _, ok := running[host]; ok {
+		return
+	}
+
+	rh := &runningHost{quit: make(chan bool), stats: &hostStats{clock: h.clock}}
+	running[host] = rh
+
+	args := resolveArgs{
+		add:  h.add,
+		del:  h.del,
+		quit: rh.quit,
+		claim: func(ips iPlist) (iPlist, bool) {
+			return h.claim(table, host, rh, ips)
+		},
+		table:   table,
+		host:    host,
+		log:     slog.With("table", table, "host", host),
+		verbose: h.cfg.Verbose,
+		dnscfg:  h.dnscfg,
+		refresh: h.cfg.refresh(host),
+		clock:   h.clock,
+
+		stats: rh.stats,
+		failed: func(o outcome, fails int) {
+			_ = h.w.i.Send(ipc.Args{Func: ResolveFailed, Argv: []string{table, host, o.String(), strconv.Itoa(fails)}})
+		},
+		nxdomainRemove: h.cfg.NXDomainRemove,
+	}
+	go resolve(args)
+}
+
+func (h *hosts) delHost(table string, host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rh, ok := h.tables[table][host]
+	if !ok {
+		return
+	}
+
+	close(rh.quit)
+	delete(h.tables[table], host)
+
+	// only remove the ips no other host in the table still has
+	orphan := h.owners.release(table, host, rh.ips)
+
+	if len(orphan) > 0 {
+		slog.Info("del ips, host removed", "table", table, "host", host, "ips", orphan)
+		h.w.del(table, orphan, why{reason: reasonRemoved, host: host})
+	}
+}
+
+// claim records the ips a host currently has in its table and returns the ips
+// it dropped that no other host claims, so they can be deleted. returns false
+// if the host has been removed and should not add anything
+func (h *hosts) claim(table string, host string, rh *runningHost, ips iPlist) (iPlist, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tables[table][host] != rh {
+		return nil, false
+	}
+
+	var dropped iPlist
+	for _, ip := range rh.ips {
+		if !ips.contains(ip) {
+			dropped.add(ip)
+		}
+	}
+
+	h.owners.claim(table, host, ips)
+	orphan := h.owners.release(table, host, dropped)
+
+	rh.ips = append(iPlist{}, ips...)
+	return orphan, true
+}
+
+// addClaimed adds the ips hosts in table still claim. a host removed after
+// claiming its answer has released them and queued their delete, holding
+// h.mu keeps the removal from coming between the check and the add
+func (h *hosts) addClaimed(table string, ips iPlist, y why) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var add iPlist
+	for _, ip := range ips {
+		if _, ok := h.owners[table][ip]; ok {
+			add.add(ip)
+		}
+	}
+	if len(add) > 0 {
+		h.w.add(table, add, y)
+	}
+}
+
+// owned how many ips hosts currently claim in table
+func (h *hosts) owned(table string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.owners[table])
+}
+
+// claimed is ip resolved by any host in table
+func (h *hosts) claimed(table string, ip string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.owners[table][ip]
+	return ok
+}
@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// outcome of resolving a host
+type outcome int
+
+// in order of preference when servers disagree
+const (
+	outcomeOK outcome = iota
+	outcomeNXDomain
+	outcomeNoData
+	outcomeServFail
+	outcomeRefused
+	outcomeError
+)
+
+func (o outcome) String() string {
+	switch o {
+	case outcomeOK:
+		return "ok"
+	case outcomeNXDomain:
+		return "nxdomain"
+	case outcomeNoData:
+		return "nodata"
+	case outcomeServFail:
+		return "servfail"
+	case outcomeRefused:
+		return "refused"
+	}
+	return "error"
+}
+
+// negative answers are authoritative, we shouldn't back off on them
+func (o outcome) negative() bool {
+	return o == outcomeNXDomain || o == outcomeNoData
+}
+
+// used when a negative answer has no SOA to take the TTL from
+const defaultNegativeTTL = 60
+
+// negativeTTL the RFC 2308 negative caching TTL of an answer, the lesser of
+// the SOA record TTL and its MINIMUM field
+func negativeTTL(r *dns.Msg) int64 {
+	for _, ns := range r.Ns {
+		if soa, ok := ns.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return int64(ttl)
+		}
+	}
+	return defaultNegativeTTL
+}
+
+// the first retry after a failed lookup waits at least this long, whatever
+// MinRefresh is
+const failRetryMin = time.Second
+
+// backoff how long to wait after fails consecutive failures, doubling from
+// MinRefresh (at least failRetryMin) up to MaxRefresh. the wait is randomized
+// between half and all of that so failing hosts don't retry in lockstep
+func (r refreshOpts) backoff(fails int) time.Duration {
+	d := r.min
+	if d < failRetryMin {
+		d = failRetryMin
+	}
+	for n := 1; n < fails && d < r.max; n++ {
+		d *= 2
+	}
+	if d > r.max {
+		d = r.max
+	}
+
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// hostStats resolution outcomes of a host, for status
+type hostStats struct {
+	mu    sync.Mutex
+	clock Clock
+
+	last     outcome
+	lastTime time.Time
+	lastOK   time.Time
+	next     time.Time
+
+	// consecutive failures and NXDOMAINs
+	fails    int
+	nxdomain int
+
+	counts map[outcome]uint64
+}
+
+// record an outcome, returns the consecutive failures and NXDOMAINs so far
+func (s *hostStats) record(o outcome) (fails int, nxdomain int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts == nil {
+		s.counts = make(map[outcome]uint64)
+	}
+	s.counts[o]++
+
+	s.last = o
+	s.lastTime = s.clock.Now()
+
+	switch {
+	case o == outcomeOK:
+		s.lastOK = s.lastTime
+		s.fails = 0
+		s.nxdomain = 0
+	case o == outcomeNXDomain:
+		s.fails = 0
+		s.nxdomain++
+	case o.negative():
+		s.fails = 0
+		s.nxdomain = 0
+	default:
+		s.fails++
+	}
+
+	return s.fails, s.nxdomain
+}
+
+func (s *hostStats) scheduled(next time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next = s.clock.Now().Add(next)
+}
+
+// HostStatus resolution state of a single host
+type HostStatus struct {
+	IPs []string
+
+	// last outcome: ok, nxdomain, nodata, servfail, refused or error
+	Last        string
+	LastTime    time.Time
+	NextResolve time.Time
+	// last time we got ips, zero if never
+	LastOK time.Time
+
+	// consecutive failed resolves
+	Failures int
+	// consecutive NXDOMAIN answers
+	NXDomains int
+
+	// count of each outcome
+	Outcomes map[string]uint64
+}
+
+func (s *hostStats) status() HostStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hs := HostStatus{
+		NextResolve: s.next,
+		LastOK:      s.lastOK,
+		Failures:    s.fails,
+		NXDomains:   s.nxdomain,
+		Outcomes:    make(map[string]uint64),
+	}
+	if !s.lastTime.IsZero() {
+		hs.Last = s.last.String()
+		hs.LastTime = s.lastTime
+	}
+	for o, n := range s.counts {
+		hs.Outcomes[o.String()] = n
+	}
+
+	return hs
+}
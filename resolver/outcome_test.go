@@ -0,0 +1,31 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		r     refreshOpts
+		fails int
+		// the wait is between half and all of max
+		max time.Duration
+	}{
+		{refreshOpts{min: 5 * time.Second, max: time.Minute}, 1, 5 * time.Second},
+		{refreshOpts{min: 5 * time.Second, max: time.Minute}, 3, 20 * time.Second},
+		{refreshOpts{min: 5 * time.Second, max: time.Minute}, 10, time.Minute},
+		// a MinRefresh below the floor doesn't hammer the server
+		{refreshOpts{min: 0, max: time.Minute}, 1, failRetryMin},
+		{refreshOpts{min: time.Millisecond, max: time.Minute}, 2, 2 * failRetryMin},
+		{refreshOpts{min: 0, max: 500 * time.Millisecond}, 1, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		for n := 0; n < 100; n++ {
+			if d := tt.r.backoff(tt.fails); d < tt.max/2 || d > tt.max {
+				t.Fatalf("%+v after %d fails: %s, want %s-%s", tt.r, tt.fails, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package resolver
+
+// owners refcounts which hosts currently claim each ip in a table, so an ip
+// shared by several hosts (CDN edges...) is only deleted when the last of
+// them drops it
+// table -> ip -> hosts
+type owners map[string]map[string]map[string]bool
+
+// claim marks ips as used by host
+func (o owners) claim(table string, host string, ips iPlist) {
+	t, ok := o[table]
+	if !ok {
+		t = make(map[string]map[string]bool)
+		o[table] = t
+	}
+
+	for _, ip := range ips {
+		hosts, ok := t[ip]
+		if !ok {
+			hosts = make(map[string]bool)
+			t[ip] = hosts
+		}
+		hosts[host] = true
+	}
+}
+
+// release drops host's claim on ips, returns the ips no host claims any longer
+func (o owners) release(table string, host string, ips iPlist) iPlist {
+	var orphan iPlist
+
+	t := o[table]
+	for _, ip := range ips {
+		hosts, ok := t[ip]
+		if !ok {
+			continue
+		}
+
+		delete(hosts, host)
+		if len(hosts) == 0 {
+			delete(t, ip)
+			orphan.add(ip)
+		}
+	}
+
+	if len(t) == 0 {
+		delete(o, table)
+	}
+
+	return orphan
+}
+
+// ips returns every ip claimed in table
+func (o owners) ips(table string) iPlist {
+	var ips iPlist
+	for ip := range o[table] {
+		ips = append(ips, ip)
+	}
+	return ips
+}
@@ -0,0 +1,152 @@
+package resolver
+
+import (
+	"sort"
+	"testing"
+
+	"git.cadurx.com/pfdns/ipc"
+)
+
+func TestOwners(t *testing.T) {
+	type step struct {
+		release bool
+		host    string
+		ips     iPlist
+		// ips release orphans
+		orphan iPlist
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		// claimed when done
+		ips iPlist
+	}{
+		{
+			name: "single host",
+			steps: []step{
+				{host: "a", ips: iPlist{"192.0.2.1", "192.0.2.2"}},
+				{release: true, host: "a", ips: iPlist{"192.0.2.1"}, orphan: iPlist{"192.0.2.1"}},
+			},
+			ips: iPlist{"192.0.2.2"},
+		},
+		{
+			name: "shared ip stays until the last host drops it",
+			steps: []step{
+				{host: "a", ips: iPlist{"192.0.2.1"}},
+				{host: "b", ips: iPlist{"192.0.2.1"}},
+				{release: true, host: "a", ips: iPlist{"192.0.2.1"}},
+				{release: true, host: "b", ips: iPlist{"192.0.2.1"}, orphan: iPlist{"192.0.2.1"}},
+			},
+		},
+		{
+			name: "claiming twice is claiming once",
+			steps: []step{
+				{host: "a", ips: iPlist{"192.0.2.1"}},
+				{host: "a", ips: iPlist{"192.0.2.1"}},
+				{release: true, host: "a", ips: iPlist{"192.0.2.1"}, orphan: iPlist{"192.0.2.1"}},
+			},
+		},
+		{
+			name: "releasing what another host claims",
+			steps: []step{
+				{host: "a", ips: iPlist{"192.0.2.1"}},
+				{release: true, host: "b", ips: iPlist{"192.0.2.1"}},
+			},
+			ips: iPlist{"192.0.2.1"},
+		},
+		{
+			name: "releasing unclaimed ips",
+			steps: []step{
+				{release: true, host: "a", ips: iPlist{"192.0.2.1"}},
+			},
+		},
+		{
+			name: "reclaimed after release",
+			steps: []step{
+				{host: "a", ips: iPlist{"192.0.2.1"}},
+				{release: true, host: "a", ips: iPlist{"192.0.2.1"}, orphan: iPlist{"192.0.2.1"}},
+				{host: "b", ips: iPlist{"192.0.2.1"}},
+			},
+			ips: iPlist{"192.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := make(owners)
+			for n, s := range tt.steps {
+				if !s.release {
+					o.claim("t", s.host, s.ips)
+					continue
+				}
+				orphan := o.release("t", s.host, s.ips)
+				if !sameIPs(orphan, s.orphan) {
+					t.Errorf("step %d: release orphaned %v, want %v", n, orphan, s.orphan)
+				}
+			}
+
+			if got := o.ips("t"); !sameIPs(got, tt.ips) {
+				t.Errorf("claimed %v, want %v", got, tt.ips)
+			}
+			if len(tt.ips) == 0 && len(o) != 0 {
+				t.Errorf("empty table kept: %v", o)
+			}
+		})
+	}
+}
+
+// tables are separate, the same ip in another table is another claim
+func TestOwnersTables(t *testing.T) {
+	o := make(owners)
+	o.claim("t", "a", iPlist{"192.0.2.1"})
+	o.claim("u", "a", iPlist{"192.0.2.1"})
+
+	if orphan := o.release("t", "a", iPlist{"192.0.2.1"}); !sameIPs(orphan, iPlist{"192.0.2.1"}) {
+		t.Errorf("release in t orphaned %v", orphan)
+	}
+	if got := o.ips("u"); !sameIPs(got, iPlist{"192.0.2.1"}) {
+		t.Errorf("u claims %v", got)
+	}
+}
+
+func sameIPs(a iPlist, b iPlist) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append(iPlist{}, a...)
+	b = append(iPlist{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// a host removed after it claimed its answer, before runAdd got to it: the
+// add is dropped and the delete stands
+func TestClaimRemovedBeforeAdd(t *testing.T) {
+	// nothing is sent to a parent within the window
+	cfg := Config{BatchWindow: "1h"}
+	h := newHosts(resolvConf{}, cfg, nil, nil, realClock{})
+	h.w = newPfWriter(&ipc.IPC{}, cfg, h.claimed, realClock{})
+	defer h.w.stop()
+
+	rh := &runningHost{quit: make(chan bool)}
+	h.tables["t"] = map[string]*runningHost{"a.test": rh}
+
+	ips := iPlist{"192.0.2.1"}
+	if _, ok := h.claim("t", "a.test", rh, ips); !ok {
+		t.Fatalf("claim failed")
+	}
+	h.delHost("t", "a.test")
+	h.addClaimed("t", ips, why{reason: reasonAnswer, host: "a.test"})
+
+	b := h.w.pending["t"]
+	if b == nil || len(b.add) != 0 || !sameIPs(b.del, ips) {
+		t.Errorf("pending %+v, want only the delete of %v", b, ips)
+	}
+}
@@ -1,39 +1,73 @@
 package resolver
 
 import (
-	"log"
+	"log/slog"
+	"sort"
 	"sync"
 	"time"
-
-	"git.cadurx.com/pfdns/ipc"
 )
 
 type updateArgs struct {
 	table string
 	ips   iPlist
+	why   why
 }
 
-// we only delete ips after deleteExpire time
-var deleteMU sync.Mutex
-var deleteQueue = make(map[string]map[string]time.Time)
+// how long the delete queue sleeps with nothing to expire
+const queueIdle = 60 * time.Minute
 
-func delPf(i *ipc.IPC, cfg config, uc chan updateArgs) {
-	var expDur time.Duration
+// DeleteAfter when the config doesn't set it
+const defaultDeleteAfter = time.Minute
 
-	if len(cfg.DeleteAfter) > 0 {
-		var err error
-		expDur, err = time.ParseDuration(cfg.DeleteAfter)
-		if err != nil {
-			log.Printf("could not parse DeleteAfter, using default")
-		}
-	}
+// an ip no host resolves to any longer, waiting to be deleted
+type pendingDelete struct {
+	// last time a host resolved to it
+	seen time.Time
+	exp  time.Time
+	why  why
+}
 
-	if expDur == 0 {
-		expDur = time.Minute * 1
+// deleteQueue holds the ips no host resolves to any longer until they are
+// deleted, DeleteAfter later. ips a host resolves to again are taken out,
+// the least recently seen are evicted early for MaxIPs. adds and deletes
+// come in on separate goroutines, so an ip is checked against the hosts'
+// claims before it's queued and again before it's deleted
+type deleteQueue struct {
+	w     *pfWriter
+	cfg   Config
+	clock Clock
+	// how many ips hosts currently claim in a table, for MaxIPs
+	owned func(string) int
+	// is ip resolved by any host in table
+	claimed func(table string, ip string) bool
+	// adds the ips hosts still claim
+	addClaimed func(table string, ips iPlist, y why)
+
+	mu     sync.Mutex
+	tables map[string]map[string]pendingDelete
+	// ips evicted per table because of MaxIPs
+	evicted map[string]uint64
+}
+
+func newDeleteQueue(w *pfWriter, cfg Config, owned func(string) int, claimed func(string, string) bool, addClaimed func(string, iPlist, why), clock Clock) *deleteQueue {
+	return &deleteQueue{
+		w:          w,
+		cfg:        cfg,
+		clock:      clock,
+		owned:      owned,
+		claimed:    claimed,
+		addClaimed: addClaimed,
+		tables:     make(map[string]map[string]pendingDelete),
+		evicted:    make(map[string]uint64),
 	}
+}
 
-	var nextTime = time.Now().Add(60 * time.Minute)
-	nextTimeout := time.NewTimer(nextTime.Sub(time.Now()))
+// runDel queues the ips sent on uc and deletes them once they expire. an
+// update without ips stops it
+func (q *deleteQueue) runDel(uc chan updateArgs) {
+	next := q.clock.Now().Add(queueIdle)
+	t := q.clock.NewTimer(queueIdle)
+	defer t.Stop()
 
 	for {
 		select {
@@ -42,100 +76,176 @@ func delPf(i *ipc.IPC, cfg config, uc chan updateArgs) {
 				return
 			}
 
-			exp := time.Now().Add(expDur)
-
-			deleteMU.Lock()
-			table, ok := deleteQueue[u.table]
-			if !ok {
-				table = make(map[string]time.Time)
-				deleteQueue[u.table] = table
+			exp := q.queue(u)
+			if !exp.After(next) {
+				next = exp
+				resetTimer(t, exp.Sub(q.clock.Now()))
 			}
 
-			for _, ip := range u.ips {
-				table[ip] = exp
-			}
-			deleteMU.Unlock()
-
-			if exp.Sub(nextTime) <= 0 {
-				nextTime = exp
-				nextTimeout.Reset(exp.Sub(time.Now()))
-			}
-
-		case <-nextTimeout.C:
-			now := time.Now()
-			minexp := now.Add(60 * time.Minute)
-
-			deleteMU.Lock()
-			for table, ent := range deleteQueue {
-
-				var del []string
-				del = append(del, table)
-				for ip, exp := range ent {
-
-					// expired?
-					if exp.Sub(now) <= 1*time.Second {
-						del = append(del, ip)
-						delete(ent, ip)
-					} else {
-						// set minexp to the next min expire time
-						if minexp.After(exp) {
-							minexp = exp
-						}
-					}
-				}
-
-				if len(del) > 1 {
-					args := ipc.Args{
-						Func: "delToTable",
-						Argv: del,
-					}
-					i.Call(args)
-				}
-			}
-			deleteMU.Unlock()
-
-			nextTime = minexp
-			nextTimeout.Reset(minexp.Sub(time.Now()))
+		case <-t.C():
+			next = q.expire()
+			resetTimer(t, next.Sub(q.clock.Now()))
 		}
 	}
 }
 
-func addPf(i *ipc.IPC, uc chan updateArgs) {
+// runAdd takes the ips sent on uc out of the queue and adds them to their
+// table, unless their host was removed since it claimed them. an update
+// without ips stops it
+func (q *deleteQueue) runAdd(uc chan updateArgs) {
 	for {
 		u := <-uc
 
 		if len(u.ips) == 0 {
 			return
 		}
-		var add []string
-		add = append(add, u.table)
-
-		// remove addips from our delete queue
-		deleteMU.Lock()
-		del, ok := deleteQueue[u.table]
-		if ok {
-			for _, ip := range u.ips {
-				_, ok := del[ip]
-				if ok {
-					delete(del, ip)
+
+		q.cancel(u)
+		q.addClaimed(u.table, u.ips, u.why)
+	}
+}
+
+// resetTimer restarts t, dropping a fire that wasn't received
+func resetTimer(t Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// queue u's ips for deletion, returns when they expire
+func (q *deleteQueue) queue(u updateArgs) time.Time {
+	now := q.clock.Now()
+	exp := now.Add(q.cfg.deleteAfter(u.table))
+	n := q.owned(u.table)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	table, ok := q.tables[u.table]
+	if !ok {
+		table = make(map[string]pendingDelete)
+		q.tables[u.table] = table
+	}
+
+	for _, ip := range u.ips {
+		// claimed again before we got to it
+		if q.claimed(u.table, ip) {
+			continue
+		}
+		table[ip] = pendingDelete{seen: now, exp: exp, why: u.why}
+	}
+	q.evict(u.table, n)
+
+	return exp
+}
+
+// cancel the deletion of u's ips, a host resolves to them again. evicts to
+// make room for them
+func (q *deleteQueue) cancel(u updateArgs) {
+	n := q.owned(u.table)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if table, ok := q.tables[u.table]; ok {
+		for _, ip := range u.ips {
+			delete(table, ip)
+		}
+	}
+
+	q.evict(u.table, n)
+}
+
+// expire deletes the ips that are due, returns when the next ones are
+func (q *deleteQueue) expire() time.Time {
+	now := q.clock.Now()
+	minexp := now.Add(queueIdle)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for table, ent := range q.tables {
+
+		del := make(map[why]iPlist)
+		for ip, pd := range ent {
+
+			switch {
+			case q.claimed(table, ip):
+				// a host resolves to it again, its add is on the way
+				delete(ent, ip)
+			case pd.exp.Sub(now) <= 1*time.Second:
+				// expired
+				del[pd.why] = append(del[pd.why], ip)
+				delete(ent, ip)
+			default:
+				// set minexp to the next min expire time
+				if minexp.After(pd.exp) {
+					minexp = pd.exp
 				}
 			}
 		}
-		deleteMU.Unlock()
 
-		add = append(add, u.ips...)
-		args := ipc.Args{
-			Func: "addToTable",
-			Argv: add,
+		for y, ips := range del {
+			q.w.del(table, ips, y)
 		}
-		i.Call(args)
 	}
+
+	return minexp
 }
 
-func flushTable(i *ipc.IPC, table string) {
-	args := ipc.Args{
-		Func: "flushTable",
-		Argv: []string{table},
+// evict deletes the least recently seen ips waiting in the queue if table
+// has more than its MaxIPs. ips hosts currently resolve to are never
+// evicted. must hold q.mu
+func (q *deleteQueue) evict(table string, owned int) {
+	max := q.cfg.TableOptions[table].MaxIPs
+	pending := q.tables[table]
+	if max == 0 {
+		return
 	}
-	i.Call(args)
+
+	// claimed again, already counted in owned
+	for ip := range pending {
+		if q.claimed(table, ip) {
+			delete(pending, ip)
+		}
+	}
+
+	over := owned + len(pending) - max
+	if max == 0 || over <= 0 || len(pending) == 0 {
+		return
+	}
+
+	var ips []string
+	for ip := range pending {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(a, b int) bool {
+		return pending[ips[a]].seen.Before(pending[ips[b]].seen)
+	})
+
+	if over > len(ips) {
+		over = len(ips)
+	}
+	ips = ips[:over]
+
+	for _, ip := range ips {
+		y := pending[ip].why
+		y.reason = reasonEvicted
+		q.w.del(table, iPlist{ip}, y)
+		delete(pending, ip)
+	}
+	q.evicted[table] += uint64(len(ips))
+
+	slog.Info("evict ips, over MaxIPs", "table", table, "ips", ips, "max", max)
+}
+
+// status of table's queue: ips waiting and evicted so far
+func (q *deleteQueue) status(table string) (pending int, evicted uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tables[table]), q.evicted[table]
 }
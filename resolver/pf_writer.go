@@ -0,0 +1,432 @@
+package resolver
+
+import (
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"git.cadurx.com/pfdns/ipc"
+)
+
+// retry backoff for changes the parent failed to apply
+const (
+	retryMin = 5 * time.Second
+	retryMax = 10 * time.Minute
+)
+
+// batching defaults
+const (
+	defaultBatchWindow = 100 * time.Millisecond
+	defaultMaxBatch    = 500
+)
+
+// pending changes to a table, sent to the parent as a single updateTable
+// request. an ip is only ever in add or del, the latest change wins
+type pfBatch struct {
+	table string
+	flush bool
+	add   iPlist
+	del   iPlist
+
+	// why each ip, and the flush, is in the batch
+	why      map[string]why
+	flushWhy why
+}
+
+func newPfBatch(table string) *pfBatch {
+	return &pfBatch{table: table, why: make(map[string]why)}
+}
+
+func (b *pfBatch) empty() bool {
+	return !b.flush && len(b.add) == 0 && len(b.del) == 0
+}
+
+// argv for the updateTable request: the table, then "flush", "+ip" to add
+// and "-ip" to delete, applied in that order. each with why, see encode
+func (b *pfBatch) argv() []string {
+	argv := []string{b.table}
+	if b.flush {
+		argv = append(argv, b.flushWhy.encode("flush"))
+	}
+	for _, ip := range b.del {
+		argv = append(argv, b.why[ip].encode("-"+ip))
+	}
+	for _, ip := range b.add {
+		argv = append(argv, b.why[ip].encode("+"+ip))
+	}
+	return argv
+}
+
+// split b into batches of at most max ips
+func (b *pfBatch) split(max int) []*pfBatch {
+	var out []*pfBatch
+
+	cur := &pfBatch{table: b.table, flush: b.flush, flushWhy: b.flushWhy, why: b.why}
+	n := 0
+	next := func() {
+		if n >= max {
+			out = append(out, cur)
+			cur = &pfBatch{table: b.table, why: b.why}
+			n = 0
+		}
+	}
+	for _, ip := range b.del {
+		next()
+		cur.del = append(cur.del, ip)
+		n++
+	}
+	for _, ip := range b.add {
+		next()
+		cur.add = append(cur.add, ip)
+		n++
+	}
+	if !cur.empty() {
+		out = append(out, cur)
+	}
+
+	return out
+}
+
+// pfWriter collects table changes for BatchWindow, coalesces them per table
+// and sends them to the parent, waiting for it to apply each batch. changes
+// that fail are retried with backoff and the table is dirty until they
+// succeed
+type pfWriter struct {
+	i     *ipc.IPC
+	clock Clock
+
+	window time.Duration
+	max    int
+
+	// is ip resolved by any host in table? retries only re-add ips that are
+	// and only re-delete ips that aren't
+	claimed func(table string, ip string) bool
+
+	// held while sending batches to the parent
+	applyMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]*pfBatch
+	wake    chan bool
+	dirty   map[string]*dirtyTable
+
+	// closed by stop
+	quit chan bool
+}
+
+// a table with changes the parent failed to apply
+type dirtyTable struct {
+	err   string
+	since time.Time
+	fails int
+	next  time.Time
+	timer Timer
+	// closed to stop waiting for timer
+	stop chan bool
+
+	add iPlist
+	del iPlist
+	why map[string]why
+}
+
+func newPfWriter(i *ipc.IPC, cfg Config, claimed func(string, string) bool, clock Clock) *pfWriter {
+	w := &pfWriter{
+		i:       i,
+		clock:   clock,
+		window:  cfg.batchWindow(),
+		max:     cfg.maxBatch(),
+		claimed: claimed,
+		pending: make(map[string]*pfBatch),
+		wake:    make(chan bool, 1),
+		dirty:   make(map[string]*dirtyTable),
+		quit:    make(chan bool),
+	}
+	go w.run()
+	return w
+}
+
+// add, del and flush never block, we're called from ipc callbacks and the
+// responses to our requests are read by the same goroutine
+
+func (w *pfWriter) add(table string, ips iPlist, y why) {
+	w.push(table, func(b *pfBatch) {
+		for _, ip := range ips {
+			b.del.rem(ip)
+			b.add.add(ip)
+			b.why[ip] = y
+		}
+	})
+}
+
+func (w *pfWriter) del(table string, ips iPlist, y why) {
+	w.push(table, func(b *pfBatch) {
+		for _, ip := range ips {
+			b.add.rem(ip)
+			b.del.add(ip)
+			b.why[ip] = y
+		}
+	})
+}
+
+func (w *pfWriter) flush(table string, y why) {
+	w.push(table, func(b *pfBatch) {
+		// everything before the flush is moot
+		b.flush = true
+		b.flushWhy = y
+		b.add, b.del = nil, nil
+		b.why = make(map[string]why)
+	})
+}
+
+func (w *pfWriter) push(table string, change func(*pfBatch)) {
+	w.mu.Lock()
+	b, ok := w.pending[table]
+	if !ok {
+		b = newPfBatch(table)
+		w.pending[table] = b
+	}
+	change(b)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- true:
+	default:
+	}
+}
+
+func (w *pfWriter) run() {
+	for {
+		select {
+		case <-w.wake:
+		case <-w.quit:
+			return
+		}
+
+		// let changes from other hosts pile up
+		t := w.clock.NewTimer(w.window)
+		select {
+		case <-t.C():
+		case <-w.quit:
+			t.Stop()
+			return
+		}
+		w.send()
+	}
+}
+
+// stop sending and retrying, once the parent of a resolver running in
+// process went away. what's pending is dropped
+func (w *pfWriter) stop() {
+	close(w.quit)
+}
+
+// drain sends everything pending right away and waits for the parent to
+// apply it, for a clean exit
+func (w *pfWriter) drain() {
+	w.send()
+}
+
+func (w *pfWriter) send() {
+	w.applyMu.Lock()
+	defer w.applyMu.Unlock()
+
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]*pfBatch)
+	w.mu.Unlock()
+
+	var tables []string
+	for table := range pending {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		for _, b := range pending[table].split(w.max) {
+			w.apply(b)
+		}
+	}
+}
+
+func (w *pfWriter) apply(b *pfBatch) {
+	if b.empty() {
+		return
+	}
+
+	args := ipc.Args{
+		Func: "updateTable",
+		Argv: b.argv(),
+	}
+
+	_, err := w.i.Request(args)
+	if err == ipc.ErrClosed {
+		// parent is gone, we're about to exit
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err != nil {
+		slog.Error("table update failed", "table", b.table, "err", err)
+		w.failed(b, err)
+		return
+	}
+
+	if d, ok := w.dirty[b.table]; ok {
+		// don't retry what just worked
+		for _, ip := range b.add {
+			d.add.rem(ip)
+			d.del.rem(ip)
+		}
+		for _, ip := range b.del {
+			d.add.rem(ip)
+			d.del.rem(ip)
+		}
+		if b.flush {
+			d.add, d.del = nil, nil
+		}
+		if len(d.add) == 0 && len(d.del) == 0 {
+			slog.Info("table clean again", "table", b.table)
+			if d.timer != nil {
+				d.timer.Stop()
+				close(d.stop)
+			}
+			delete(w.dirty, b.table)
+		}
+	}
+}
+
+// failed marks b's table dirty and schedules a retry, must hold w.mu
+func (w *pfWriter) failed(b *pfBatch, err error) {
+	d, ok := w.dirty[b.table]
+	if !ok {
+		d = &dirtyTable{since: w.clock.Now(), why: make(map[string]why)}
+		w.dirty[b.table] = d
+	}
+	d.err = err.Error()
+	d.fails++
+
+	// the latest change for an ip wins
+	for _, ip := range b.del {
+		d.add.rem(ip)
+		d.del.add(ip)
+		d.why[ip] = b.why[ip]
+	}
+	for _, ip := range b.add {
+		d.del.rem(ip)
+		d.add.add(ip)
+		d.why[ip] = b.why[ip]
+	}
+
+	// a failed flush stays dirty but isn't retried, flushing later would
+	// remove everything added since
+	if d.timer != nil || (len(d.add) == 0 && len(d.del) == 0) {
+		return
+	}
+
+	wait := retryMin
+	for n := 1; n < d.fails && wait < retryMax; n++ {
+		wait *= 2
+	}
+	if wait > retryMax {
+		wait = retryMax
+	}
+	wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+
+	d.next = w.clock.Now().Add(wait)
+	d.timer = w.clock.NewTimer(wait)
+	d.stop = make(chan bool)
+	go w.retryAfter(b.table, d.timer, d.stop)
+}
+
+// retryAfter retries table once t fires, unless it's clean by then
+func (w *pfWriter) retryAfter(table string, t Timer, stop chan bool) {
+	select {
+	case <-t.C():
+		w.retry(table)
+	case <-stop:
+	case <-w.quit:
+		t.Stop()
+	}
+}
+
+// retry re-queues a dirty tables failed changes that are still wanted
+func (w *pfWriter) retry(table string) {
+	w.mu.Lock()
+	d, ok := w.dirty[table]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	d.timer, d.stop = nil, nil
+	add, del := d.add, d.del
+	whys := make(map[string]why, len(d.why))
+	for ip, y := range d.why {
+		whys[ip] = y
+	}
+	w.mu.Unlock()
+
+	var readd, redel iPlist
+	for _, ip := range add {
+		if w.claimed(table, ip) {
+			readd.add(ip)
+		}
+	}
+	for _, ip := range del {
+		if !w.claimed(table, ip) {
+			redel.add(ip)
+		}
+	}
+
+	w.mu.Lock()
+	// no longer wanted, nothing to retry
+	for _, ip := range add {
+		if !readd.contains(ip) {
+			d.add.rem(ip)
+		}
+	}
+	for _, ip := range del {
+		if !redel.contains(ip) {
+			d.del.rem(ip)
+		}
+	}
+	if len(d.add) == 0 && len(d.del) == 0 {
+		delete(w.dirty, table)
+	}
+	w.mu.Unlock()
+
+	slog.Info("retry table update", "table", table, "add", readd, "del", redel)
+
+	// keep who caused the change
+	for _, ip := range redel {
+		y := whys[ip]
+		y.reason = reasonReconcile
+		w.del(table, iPlist{ip}, y)
+	}
+	for _, ip := range readd {
+		y := whys[ip]
+		y.reason = reasonReconcile
+		w.add(table, iPlist{ip}, y)
+	}
+}
+
+// dirtyStatus fills in ts for table
+func (w *pfWriter) dirtyStatus(table string, ts *TableStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	d, ok := w.dirty[table]
+	if !ok {
+		return
+	}
+
+	ts.Dirty = true
+	ts.Error = d.err
+	ts.DirtySince = d.since
+	ts.FailedAdds = len(d.add)
+	ts.FailedDeletes = len(d.del)
+	ts.NextRetry = d.next
+}
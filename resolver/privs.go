@@ -0,0 +1,90 @@
+package resolver
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Privs the resolver drops to after it has its files open
+type Privs struct {
+	User string
+	// Group "" uses the user's primary group
+	Group  string
+	Chroot string
+}
+
+// drop chroots and setuids to p, nothing that can fail is left for after
+// the chroot as /etc is gone by then
+func (p Privs) drop() error {
+	u, err := user.Lookup(p.User)
+	if err != nil {
+		return fmt.Errorf("user %s: %s", p.User, err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if len(p.Group) > 0 {
+		g, err := user.LookupGroup(p.Group)
+		if err != nil {
+			return fmt.Errorf("group %s: %s", p.Group, err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid == 0 {
+		return fmt.Errorf("user %s is root", p.User)
+	}
+
+	err = checkChroot(p.Chroot)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Chroot(p.Chroot)
+	if err != nil {
+		return fmt.Errorf("could not chroot %s: %s", p.Chroot, err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return fmt.Errorf("could not chdir /: %s", err)
+	}
+
+	// drop groups too, root's supplementary groups would survive setgid
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("setgid: %s", err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("setuid: %s", err)
+	}
+
+	return nil
+}
+
+// checkChroot the resolver must not be able to plant anything in its chroot,
+// it has to be a root owned directory only root can write to
+func checkChroot(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("chroot: %s", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("chroot %s: not a directory", dir)
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && st.Uid != 0 {
+		return fmt.Errorf("chroot %s: owned by uid %d, not root", dir, st.Uid)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("chroot %s: writable by group or others (%s)", dir, fi.Mode().Perm())
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package resolver
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// refresh defaults
+const (
+	defaultMinRefresh = 5 * time.Second
+	defaultMaxRefresh = 10 * time.Minute
+	defaultPrefetch   = 90
+	defaultJitter     = 10
+)
+
+// HostOptions per host overrides of the global refresh settings
+type HostOptions struct {
+	MinRefresh string
+	MaxRefresh string
+	Prefetch   *int
+	Jitter     *int
+}
+
+// how often a host is re-resolved
+type refreshOpts struct {
+	min time.Duration
+	max time.Duration
+
+	// re-resolve at this percent of the TTL
+	prefetch int
+	// re-resolve up to this percent early, spreads out hosts that were
+	// resolved at the same time (startup)
+	jitter int
+}
+
+// refresh settings for host, per host options override the global ones
+func (c Config) refresh(host string) refreshOpts {
+	r := refreshOpts{
+		min:      defaultMinRefresh,
+		max:      defaultMaxRefresh,
+		prefetch: defaultPrefetch,
+		jitter:   defaultJitter,
+	}
+
+	// all checked in ParseConfig
+	set := func(min string, max string, prefetch *int, jitter *int) {
+		if len(min) > 0 {
+			r.min, _ = time.ParseDuration(min)
+		}
+		if len(max) > 0 {
+			r.max, _ = time.ParseDuration(max)
+		}
+		if prefetch != nil {
+			r.prefetch = *prefetch
+		}
+		if jitter != nil {
+			r.jitter = *jitter
+		}
+	}
+
+	set(c.MinRefresh, c.MaxRefresh, c.Prefetch, c.Jitter)
+	if opts, ok := c.HostOptions[host]; ok {
+		set(opts.MinRefresh, opts.MaxRefresh, opts.Prefetch, opts.Jitter)
+	}
+
+	return r
+}
+
+// checkRefresh validates the refresh settings for host
+func (c Config) checkRefresh(host string) error {
+	check := func(min string, max string, prefetch *int, jitter *int) error {
+		for _, d := range []struct{ name, v string }{{"MinRefresh", min}, {"MaxRefresh", max}} {
+			if len(d.v) == 0 {
+				continue
+			}
+			v, err := time.ParseDuration(d.v)
+			if err != nil {
+				return err
+			}
+			// 0 would re-resolve a TTL 0 answer in a tight loop
+			if v <= 0 {
+				return fmt.Errorf("%s %s not > 0", d.name, d.v)
+			}
+		}
+		if prefetch != nil && (*prefetch < 1 || *prefetch > 100) {
+			return fmt.Errorf("Prefetch %d not 1-100", *prefetch)
+		}
+		if jitter != nil && (*jitter < 0 || *jitter > 100) {
+			return fmt.Errorf("Jitter %d not 0-100", *jitter)
+		}
+		return nil
+	}
+
+	err := check(c.MinRefresh, c.MaxRefresh, c.Prefetch, c.Jitter)
+	if err != nil {
+		return err
+	}
+
+	if opts, ok := c.HostOptions[host]; ok {
+		err = check(opts.MinRefresh, opts.MaxRefresh, opts.Prefetch, opts.Jitter)
+		if err != nil {
+			return err
+		}
+	}
+
+	r := c.refresh(host)
+	if r.min > r.max {
+		return fmt.Errorf("MinRefresh %s > MaxRefresh %s", r.min, r.max)
+	}
+
+	return nil
+}
+
+// next how long to wait before re-resolving an answer with a ttl in seconds
+func (r refreshOpts) next(ttl int64) time.Duration {
+	d := time.Duration(ttl) * time.Second * time.Duration(r.prefetch) / 100
+	if r.prefetch == 100 {
+		// try again 1s after the TTL expires
+		d += time.Second
+	}
+
+	if r.jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Int63n(int64(d)*int64(r.jitter)/100 + 1))
+	}
+
+	return r.clamp(d)
+}
+
+// clamp d to MinRefresh/MaxRefresh
+func (r refreshOpts) clamp(d time.Duration) time.Duration {
+	if d < r.min {
+		d = r.min
+	}
+	if d > r.max {
+		d = r.max
+	}
+	return d
+}
@@ -1,9 +1,8 @@
 package resolver
 
 import (
-	"log"
+	"log/slog"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -15,11 +14,26 @@ type resolveArgs struct {
 	flush chan bool
 	quit  chan bool
 
-	dnscfg resolvConf
+	// records the ips we have in the table, returns the ones we dropped that
+	// no other host in the table has. false if we've been removed
+	claim func(iPlist) (iPlist, bool)
+
+	dnscfg  resolvConf
+	refresh refreshOpts
+	clock   Clock
+
+	// resolution outcomes, for status
+	stats *hostStats
+	// tell the parent we failed to resolve, for its hooks
+	failed func(o outcome, fails int)
+	// remove our ips after this many NXDOMAINs in a row, 0 never
+	nxdomainRemove int
 
 	table string
 	host  string
 
+	// log with the table and host
+	log     *slog.Logger
 	verbose uint8
 }
 
@@ -35,104 +49,166 @@ func resolve(args resolveArgs) {
 	m.SetQuestion(dns.Fqdn(args.host), dns.TypeA)
 	m.RecursionDesired = true
 
-	// if we fail, sleep longer and longer up to 10 min
-	failTTL := make([]int64, len(args.dnscfg.servers))
-
 	// we keep track of the last ips we added and remove them if they changed
 	var curIP iPlist
 	for {
 		var gotIP iPlist
+		// the first server that answered with each ip, for the audit log
+		from := make(map[string]string)
 
-		if args.verbose > 0 {
-			log.Printf("resolve %s", args.host)
-		}
+		args.log.Debug("resolve")
 
-		// recheck every 10 minutes, even if the dns TTL says we could cache
+		// recheck every MaxRefresh, even if the dns TTL says we could cache
 		// for longer
-		var minTTL int64 = 600
+		var minTTL = int64(args.refresh.max / time.Second)
+
+		// the best outcome of all servers
+		best := outcomeError
+		var negTTL int64
+
+		for _, server := range args.dnscfg.servers {
+			respIP, ttl, out := resolv(server, c, &m, args)
+
+			if out < best {
+				best = out
+			}
 
-		for idx, server := range args.dnscfg.servers {
-			respIP := resolv(server, c, &m, args, &failTTL[idx], &minTTL)
+			switch {
+			case out == outcomeOK:
+				if ttl < minTTL {
+					minTTL = ttl
+				}
+			case out.negative():
+				if negTTL == 0 || ttl < negTTL {
+					negTTL = ttl
+				}
+			}
 
 			for _, ip := range respIP {
+				if !gotIP.contains(ip) {
+					from[ip] = server
+				}
 				gotIP.add(ip)
 			}
 		}
 
-		// only add/remove if we got IPs to add
-		// for example if networking went down for a second, we don't want to remove old ips
-		if len(gotIP) > 0 {
-			curIP = _updatePf(args, minTTL, gotIP, curIP)
+		fails, nxdomain := args.stats.record(best)
+
+		var wait time.Duration
+		switch {
+		case best == outcomeOK:
+			// only add/remove if we got an answer with ips
+			// for example if networking went down for a second, we don't want to remove old ips
+			curIP = _updatePf(args, minTTL, gotIP, curIP, from)
+
+			// before the TTL expires, within MinRefresh/MaxRefresh
+			wait = args.refresh.next(minTTL)
+
+		case best.negative():
+			// the name (or its A record) is gone, ask again when the
+			// negative answer expires
+			wait = args.refresh.clamp(time.Duration(negTTL) * time.Second)
 
-			// try again 1s after the TTL expires
-			minTTL++
+			if best == outcomeNXDomain && args.nxdomainRemove > 0 && nxdomain >= args.nxdomainRemove && len(curIP) > 0 {
+				args.log.Info("del ips, NXDOMAIN", "ips", curIP, "nxdomains", nxdomain)
+				curIP = _removeAll(args)
+			}
+
+		default:
+			// servfail, refused, timeout... keep the ips we have and back off
+			wait = args.refresh.backoff(fails)
+			args.failed(best, fails)
+			args.log.Warn("resolve failed", "outcome", best.String(), "fails", fails, "retry", wait)
 		}
 
+		args.stats.scheduled(wait)
+
+		if args.verbose > 1 {
+			args.log.Debug("next resolve", "in", wait)
+		}
+
+		t := args.clock.NewTimer(wait)
 		select {
-		case <-time.After(time.Duration(minTTL) * time.Second):
+		case <-t.C():
 			// re-resolv
 		case <-args.flush:
+			t.Stop()
 			if args.verbose > 1 {
-				log.Printf("flush %s", args.host)
+				args.log.Debug("flush")
 			}
 			curIP = nil
 		case <-args.quit:
-			if args.verbose > 0 {
-				log.Printf("stop %s", args.host)
-			}
+			t.Stop()
+			args.log.Debug("stop")
 			return
 		}
 	}
 }
 
-// returns a list of resolved ips
-func resolv(server string, c dns.Client, m *dns.Msg, args resolveArgs, failTTL *int64, minTTL *int64) iPlist {
+// returns a list of resolved ips, the ttl of the answer (the negative caching
+// ttl for NXDOMAIN/NODATA) and what kind of answer we got
+func resolv(server string, c dns.Client, m *dns.Msg, args resolveArgs) (iPlist, int64, outcome) {
 	var gotIP iPlist
 
-	r, _, err := c.Exchange(m, net.JoinHostPort(server, "53"))
+	// host:port for servers not on port 53, like a test's
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "53")
+	}
+
+	r, _, err := c.Exchange(m, addr)
 	if r == nil {
-		log.Printf("exchange failed %s: %s", args.host, err)
-		_bumpfail(failTTL, minTTL)
-		return gotIP
+		args.log.Warn("exchange failed", "server", server, "err", err)
+		return gotIP, 0, outcomeError
 	}
 
-	if r.Rcode != dns.RcodeSuccess {
-		log.Printf("invalid answer %s", args.host)
-		_bumpfail(failTTL, minTTL)
-		return gotIP
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		args.log.Debug("NXDOMAIN", "server", server)
+		return gotIP, negativeTTL(r), outcomeNXDomain
+	case dns.RcodeRefused:
+		args.log.Warn("refused", "server", server)
+		return gotIP, 0, outcomeRefused
+	default:
+		args.log.Warn("invalid answer", "server", server, "rcode", dns.RcodeToString[r.Rcode])
+		return gotIP, 0, outcomeServFail
 	}
 
+	var minTTL int64 = -1
 	for _, ans := range r.Answer {
 		if a, ok := ans.(*dns.A); ok {
 			if args.verbose > 1 {
-				log.Printf("host %s -> %s, ttl %d\n", args.host, a.A, a.Hdr.Ttl)
+				args.log.Debug("answer", "server", server, "ip", a.A.String(), "ttl", a.Hdr.Ttl)
 			}
 
-			if a.Hdr.Ttl < uint32(*minTTL) {
-				*minTTL = int64(a.Hdr.Ttl)
+			if minTTL < 0 || int64(a.Hdr.Ttl) < minTTL {
+				minTTL = int64(a.Hdr.Ttl)
 			}
 
 			var ip = a.A.String()
 			gotIP.add(ip)
-
-			// reset failTTL for this server on any success
-			*failTTL = 0
 		}
 	}
 
-	return gotIP
+	if len(gotIP) == 0 {
+		args.log.Debug("no A records", "server", server)
+		return gotIP, negativeTTL(r), outcomeNoData
+	}
+
+	return gotIP, minTTL, outcomeOK
 }
 
-func _bumpfail(failTTL *int64, minTTL *int64) {
-	// slow down queries till we are retrying every 10 min
-	*failTTL += 30
-	if *failTTL > 600 {
-		*failTTL = 600
+// _removeAll drops all our ips from the table, returns the new (empty) curIP
+func _removeAll(args resolveArgs) iPlist {
+	orphan, ok := args.claim(nil)
+	if ok && len(orphan) > 0 {
+		args.del <- updateArgs{ips: orphan, table: args.table, why: why{reason: reasonNXDomain, host: args.host}}
 	}
-	*minTTL = *failTTL
+	return nil
 }
 
-func _updatePf(args resolveArgs, minTTL int64, gotIP iPlist, curIP iPlist) iPlist {
+func _updatePf(args resolveArgs, minTTL int64, gotIP iPlist, curIP iPlist, from map[string]string) iPlist {
 	var addIP iPlist
 	var delIP iPlist
 
@@ -149,14 +225,30 @@ func _updatePf(args resolveArgs, minTTL int64, gotIP iPlist, curIP iPlist) iPlis
 		}
 	}
 
-	if len(addIP) > 0 {
-		log.Printf("add %s:%s ttl:%d %s, del:%s, l:%s, g:%s", args.table, args.host, minTTL, addIP, delIP, curIP, gotIP)
+	if len(addIP) > 0 || len(delIP) > 0 {
+		// even an answer that only shrank releases what it dropped
+		orphan, ok := args.claim(gotIP)
+		if !ok {
+			// we were removed from the config, leave the table alone
+			return curIP
+		}
 
-		// send off IPC message to parent
-		args.add <- updateArgs{ips: addIP, table: args.table}
+		args.log.Info("update ips", "ttl", minTTL, "ips", addIP, "del", delIP, "last", curIP, "got", gotIP)
 
-		if len(delIP) > 0 {
-			args.del <- updateArgs{ips: delIP, table: args.table}
+		// send off IPC message to parent, per server that gave us the ips
+		byServer := make(map[string]iPlist)
+		for _, ip := range addIP {
+			byServer[from[ip]] = append(byServer[from[ip]], ip)
+		}
+		for server, ips := range byServer {
+			y := why{reason: reasonAnswer, host: args.host, server: server, ttl: minTTL}
+			args.add <- updateArgs{ips: ips, table: args.table, why: y}
+		}
+
+		// ips we dropped that other hosts in the table still resolve to stay,
+		// the rest are deleted once they expire
+		if len(orphan) > 0 {
+			args.del <- updateArgs{ips: orphan, table: args.table, why: why{reason: reasonExpiry, host: args.host}}
 		}
 
 		// update our curIP to all the ones we "got" this round
@@ -164,7 +256,7 @@ func _updatePf(args resolveArgs, minTTL int64, gotIP iPlist, curIP iPlist) iPlis
 	}
 
 	if args.verbose > 1 {
-		log.Printf("no diff %s:%s ttl:%d %s, del:%s, l:%s, g:%s", args.table, args.host, minTTL, addIP, delIP, curIP, gotIP)
+		args.log.Debug("no diff", "ttl", minTTL, "ips", curIP, "got", gotIP)
 	}
 
 	// no changes, keep our current list of IPs
@@ -176,16 +268,16 @@ func doStatic(args resolveArgs) {
 		var addIP iPlist
 		addIP.add(args.host)
 
-		log.Printf("add %s:%s", args.table, strings.Join(addIP, ","))
-		args.add <- updateArgs{ips: addIP, table: args.table}
+		if _, ok := args.claim(addIP); ok {
+			args.log.Info("add ips", "ips", addIP)
+			args.add <- updateArgs{ips: addIP, table: args.table, why: why{reason: reasonStatic, host: args.host}}
+		}
 
 		select {
 		case <-args.flush:
 			// reload now
 		case <-args.quit:
-			if args.verbose > 0 {
-				log.Printf("stop %s", args.host)
-			}
+			args.log.Debug("stop")
 			return
 		}
 	}
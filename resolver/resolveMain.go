@@ -2,39 +2,41 @@ package resolver
 
 import (
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
-	"os/user"
-	"runtime"
-	"strconv"
 	"syscall"
 
 	"git.cadurx.com/pfdns/ipc"
+	"git.cadurx.com/pfdns/logging"
+	"git.cadurx.com/pfdns/pledge"
 )
 
 // Main entry point for resolver subprocess
-func Main(noChroot bool) {
+func Main(noChroot bool, privs Privs) {
 	quitSig := make(chan os.Signal, 1)
 	signal.Notify(quitSig, os.Interrupt, os.Kill, syscall.SIGTERM)
 	reloadSig := make(chan os.Signal, 1)
 	signal.Notify(reloadSig, syscall.SIGHUP)
 
-	parentQuit := run(noChroot)
+	parentQuit, w := run(noChroot, privs)
 	for {
 		select {
 		case s := <-quitSig:
-			log.Fatalf("resolver exiting: got sig %s", s)
+			// the parent is waiting for us to finish our table updates
+			slog.Info("resolver exiting", "sig", s.String())
+			w.drain()
+			os.Exit(0)
 		case s := <-reloadSig:
-			log.Fatalf("resolver exiting: got sig %s", s)
+			logging.Fatal("resolver exiting", "sig", s.String())
 		case <-parentQuit:
-			log.Fatalf("parent quit")
+			logging.Fatal("parent quit")
 		}
 	}
 }
 
-func run(noChroot bool) chan bool {
+func run(noChroot bool, privs Privs) (chan bool, *pfWriter) {
 	parentQuit := make(chan bool)
 
 	parentPipe := os.NewFile(3, "read parent pipe")
@@ -46,103 +48,154 @@ func run(noChroot bool) chan bool {
 	i := &ipc.IPC{}
 	i.Writer(parentWrite)
 
+	// our stderr is whatever the parent had, log through it instead
+	slog.SetDefault(slog.New(logging.Forward(func(argv []string) error {
+		return i.Send(ipc.Args{Func: "log", Argv: argv})
+	}, logging.Level)))
+
 	if !noChroot {
-		u, err := user.Lookup("nobody")
+		err := privs.drop()
 		if err != nil {
 			i.WriteFatal(err)
 		}
-
-		err = syscall.Chroot("/var/empty")
-		if err != nil {
-			i.WriteFatal(fmt.Errorf("could not chroot /var/empty: %s", err))
-		}
-		err = syscall.Chdir("/")
-		if err != nil {
-			i.WriteFatal(fmt.Errorf("could not chdir /: %s", err))
-		}
-
-		// well that's dumb, this don't work in linux
-		if runtime.GOOS != "linux" {
-			id, _ := strconv.Atoi(u.Gid)
-			err = syscall.Setgid(id)
-			if err != nil {
-				i.WriteFatal(fmt.Errorf("setgid: %s", err))
-			}
-			id, _ = strconv.Atoi(u.Uid)
-			err = syscall.Setuid(id)
-			if err != nil {
-				i.WriteFatal(fmt.Errorf("setuid: %s", err))
-			}
-		}
 	}
 
-	// needs __set_tcp :-(
-	//pledge.Pledge("stdio inet", nil)
-
 	// all chrooted, try parsing config
 	dnscfg, cfg, err := loadConfig(resolv, config)
 	if err != nil {
 		i.WriteFatal(err)
 	}
+	// the whole process is ours, unlike with Serve
+	if cfg.Verbose > 0 {
+		logging.Level.Set(slog.LevelDebug)
+	}
+	slog.Debug("config", "cfg", fmt.Sprintf("%+v", cfg))
 	_ = resolv.Close()
 	_ = config.Close()
 
-	go func() {
-		for {
-			_, _ = ioutil.ReadAll(parentPipe)
-			parentQuit <- true
+	// from here on we only talk to our parent and dns servers. no files at
+	// all, unveil first as pledge would forbid it
+	err = pledge.Unveil("/", "")
+	if err == nil {
+		err = pledge.UnveilBlock()
+	}
+	switch {
+	case err == pledge.ErrCgo:
+		// still pledged and chrooted, but say we're less confined than asked
+		slog.Error("unveil not applied, the resolver can open files", "err", err)
+	case err != nil && err != pledge.ErrUnsupported:
+		i.WriteFatal(fmt.Errorf("unveil: %s", err))
+	}
+	err = pledge.Pledge("stdio inet dns", "")
+	if err != nil && err != pledge.ErrUnsupported {
+		i.WriteFatal(fmt.Errorf("pledge: %s", err))
+	}
+	// on FreeBSD only the pipes are limited, the resolver is otherwise
+	// confined by its chroot and user alone
+	for f, perms := range map[*os.File]string{parentPipe: "r", parentWrite: "w"} {
+		err = pledge.LimitFile(f, perms)
+		if err != nil && err != pledge.ErrUnsupported {
+			i.WriteFatal(fmt.Errorf("limit %s: %s", f.Name(), err))
 		}
+	}
+
+	h := start(i, dnscfg, cfg, realClock{})
+
+	// the parent sends us reload messages on parentPipe, it's closed when the
+	// parent dies
+	go func() {
+		i.Reader(parentPipe)
+		parentQuit <- true
 	}()
 
-	add := make(chan updateArgs, 100)
-	go addPf(i, add)
+	if err := h.startup(); err != nil {
+		logging.Fatal("startup", "err", err)
+	}
+
+	return parentQuit, h.w
+}
+
+// Serve runs a resolver in this process, without privilege separation: it
+// reads the parent's messages from r and writes to w, like the subprocess
+// does on fds 3 and 4. it returns once the tables are being resolved, they
+// stop when r is closed. drain sends the pending table updates and waits for
+// the parent to apply them, before closing r for a clean stop. a nil clock
+// is the real one. Serve doesn't exit or change the global log level, errors
+// are returned with r closed
+func Serve(r io.ReadCloser, w io.Writer, resolv io.Reader, config io.Reader, clock Clock) (drain func(), err error) {
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	dnscfg, cfg, err := loadConfig(resolv, config)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+
+	i := &ipc.IPC{}
+	i.Writer(w)
+
+	h := start(i, dnscfg, cfg, clock)
+	go func() {
+		i.Reader(r)
+		h.stop()
+	}()
+
+	if err := h.startup(); err != nil {
+		// the reader stops the rest
+		_ = r.Close()
+		return nil, err
+	}
 
+	return h.w.drain, nil
+}
+
+// start the table writer and delete queue, ready for hosts. hosts resolve
+// and expire on clock
+func start(i *ipc.IPC, dnscfg resolvConf, cfg Config, clock Clock) *hosts {
+	add := make(chan updateArgs, 100)
 	del := make(chan updateArgs, 100)
-	go delPf(i, cfg, del)
 
+	h := newHosts(dnscfg, cfg, add, del, clock)
+	h.w = newPfWriter(i, cfg, h.claimed, clock)
+	h.q = newDeleteQueue(h.w, cfg, h.owned, h.claimed, h.addClaimed, clock)
+	h.ipcInit(i)
+
+	go h.q.runAdd(add)
+	go h.q.runDel(del)
+
+	return h
+}
+
+// startup tells the parent we're up, then resolves the config's tables
+func (h *hosts) startup() error {
 	// startup complete, let our parent know so it will respawn us if we die
 	ia := ipc.Args{
 		Func: "startup",
 	}
-	i.Call(ia)
-
-	for table, hosts := range cfg.Tables {
-		//if *noFlush == false {
-		flushTable(i, table)
-		//}
+	if err := h.w.i.Send(ia); err != nil {
+		return fmt.Errorf("ipc startup: %s", err)
+	}
 
+	for table, hosts := range h.cfg.Tables {
+		h.addTable(table)
 		for _, host := range hosts {
-			args := resolveArgs{
-				add:     add,
-				del:     del,
-				quit:    parentQuit,
-				table:   table,
-				host:    host,
-				verbose: cfg.Verbose,
-				dnscfg:  dnscfg,
-			}
-			go resolve(args)
+			h.addHost(table, host)
 		}
 	}
-
-	return parentQuit
+	return nil
 }
 
-func loadConfig(dnsFile *os.File, cfgFile *os.File) (resolvConf, config, error) {
+func loadConfig(dnsFile io.Reader, cfgFile io.Reader) (resolvConf, Config, error) {
 	dnscfg, err := resolvConfFromReader(dnsFile)
 	if err != nil {
-		return resolvConf{}, config{}, err
+		return resolvConf{}, Config{}, err
 	}
 
-	cfg, err := parseConfig(cfgFile)
+	cfg, err := ParseConfig(cfgFile)
 	if err != nil {
-		return resolvConf{}, config{}, err
-	}
-	//if *verbose {
-	//	conf.Verbose = 2
-	//}
-	if cfg.Verbose > 0 {
-		log.Printf("%+v", cfg)
+		return resolvConf{}, Config{}, err
 	}
 
 	return dnscfg, cfg, nil
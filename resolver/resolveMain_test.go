@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"git.cadurx.com/pfdns/logging"
+)
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("parent gone")
+}
+
+// an embedding program gets Serve's errors back, it isn't exited and its
+// log level is left alone
+func TestServeErrors(t *testing.T) {
+	level := logging.Level.Level()
+	defer logging.Level.Set(level)
+	logging.Level.Set(slog.LevelInfo)
+
+	r, pw := io.Pipe()
+	defer pw.Close()
+	resolv := "nameserver 192.0.2.53\n"
+	_, err := Serve(r, failWriter{}, strings.NewReader(resolv), strings.NewReader(`{"Verbose": 1}`), nil)
+	if err == nil {
+		t.Fatalf("Serve with a broken writer succeeded")
+	}
+	if _, err := pw.Write([]byte{0}); err == nil {
+		t.Errorf("r left open")
+	}
+
+	r, pw = io.Pipe()
+	defer pw.Close()
+	_, err = Serve(r, io.Discard, strings.NewReader(resolv), strings.NewReader(`{"Verbose": 1, "MinRefresh": "0s"}`), nil)
+	if err == nil {
+		t.Fatalf("Serve with a bad config succeeded")
+	}
+
+	if got := logging.Level.Level(); got != slog.LevelInfo {
+		t.Errorf("log level changed to %s", got)
+	}
+}
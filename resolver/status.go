@@ -0,0 +1,81 @@
+package resolver
+
+import (
+	"encoding/json"
+	"time"
+
+	"git.cadurx.com/pfdns/ipc"
+)
+
+// Status of a running resolver, sent to the parent as json when it asks for
+// it with a getStatus request
+type Status struct {
+	Tables map[string]TableStatus
+}
+
+// TableStatus retention state of a single table
+type TableStatus struct {
+	Hosts map[string]HostStatus
+
+	// retention policy in effect
+	DeleteAfter string
+	MaxIPs      int
+
+	// ips hosts currently resolve to
+	IPs int
+	// ips no host resolves to, waiting for DeleteAfter
+	Pending int
+	// ips removed early because of MaxIPs
+	Evicted uint64
+
+	// the parent failed to apply some changes, they are retried at
+	// NextRetry
+	Dirty         bool
+	Error         string
+	DirtySince    time.Time
+	FailedAdds    int
+	FailedDeletes int
+	NextRetry     time.Time
+}
+
+func (h *hosts) status() Status {
+	st := Status{Tables: make(map[string]TableStatus)}
+
+	h.mu.Lock()
+	for table, running := range h.tables {
+		ts := TableStatus{
+			DeleteAfter: h.cfg.deleteAfter(table).String(),
+			MaxIPs:      h.cfg.TableOptions[table].MaxIPs,
+			IPs:         len(h.owners[table]),
+			Hosts:       make(map[string]HostStatus),
+		}
+		for host, rh := range running {
+			hs := rh.stats.status()
+			hs.IPs = rh.ips
+			ts.Hosts[host] = hs
+		}
+		st.Tables[table] = ts
+	}
+	h.mu.Unlock()
+
+	for table, ts := range st.Tables {
+		ts.Pending, ts.Evicted = h.q.status(table)
+		st.Tables[table] = ts
+	}
+
+	for table, ts := range st.Tables {
+		h.w.dirtyStatus(table, &ts)
+		st.Tables[table] = ts
+	}
+
+	return st
+}
+
+// statusRequest answers the parents getStatus request with our status as json
+func (h *hosts) statusRequest(args ipc.Args) ([]string, error) {
+	blob, err := json.Marshal(h.status())
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(blob)}, nil
+}
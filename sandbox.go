@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"git.cadurx.com/pfdns/pledge"
+)
+
+// sandbox restricts the parent to running pfctl and the resolver and to
+// reading its config, on OpenBSD
+func sandbox(exe string) error {
+	// landlock and seccomp carry over exec, they would confine pfctl and the
+	// resolver before it chroots. the resolver sandboxes itself
+	if runtime.GOOS == "linux" {
+		return nil
+	}
+
+	unveil := map[string]string{
+		// pfctl opens /dev/pf itself, unveil doesn't carry over exec
+		"/sbin/pfctl": "x",
+		*cfgPath:      "r",
+		*resolvConf:   "r",
+	}
+	if len(exe) > 0 {
+		// respawning the resolver, none with -single
+		unveil[exe] = "x"
+	}
+
+	// the watcher needs the directories, and whatever a symlink points to
+	for _, path := range []string{*cfgPath, *resolvConf} {
+		unveil[filepath.Dir(path)] = "r"
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			unveil[filepath.Dir(target)] = "r"
+		}
+	}
+
+	if len(*statusPath) > 0 {
+		unveil[*statusPath] = "rwc"
+	}
+	if exportFile != nil {
+		// tables are written next to their files, then renamed over them
+		unveil[exportFile.Dir()] = "rwc"
+		if reload := strings.Fields(*exportReload); len(reload) > 0 {
+			unveil[reload[0]] = "x"
+		}
+	}
+	if len(*auditPath) > 0 {
+		// reopened on SIGHUP, after newsyslog rotated it
+		unveil[*auditPath] = "wc"
+	}
+
+	// hooks added by a reload later can't run unless their commands are
+	// already unveiled, or can't post if none posted before
+	cfg, _ := readConfig()
+	var posts bool
+	for _, h := range cfg.Hooks {
+		if len(h.Command) > 0 {
+			unveil[h.Command[0]] = "x"
+		}
+		posts = posts || len(h.URL) > 0
+	}
+
+	promises := "stdio rpath wpath cpath proc exec"
+	if len(*healthAddr) > 0 || posts || *single {
+		// accepting health checks, posting to hooks, resolving
+		promises += " inet"
+	}
+	if posts || *single {
+		promises += " dns"
+	}
+	if posts {
+		// resolving the hook url's host
+		unveil["/etc/hosts"] = "r"
+		unveil["/etc/resolv.conf"] = "r"
+	}
+	if *logFormat == "syslog" {
+		// log/syslog reconnects when syslogd restarts
+		unveil["/dev/log"] = "rw"
+		promises += " unix"
+	}
+
+	for path, perms := range unveil {
+		err := pledge.Unveil(path, perms)
+		if err == pledge.ErrUnsupported {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unveil %s: %s", path, err)
+		}
+	}
+	if err := pledge.UnveilBlock(); err != nil {
+		return fmt.Errorf("unveil: %s", err)
+	}
+
+	// the resolver has to chroot before it can pledge itself and pfctl needs
+	// ioctls on /dev/pf, so programs we exec aren't restricted
+	err := pledge.Pledge(promises, "")
+	if err != nil && err != pledge.ErrUnsupported {
+		return fmt.Errorf("pledge: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"git.cadurx.com/pfdns/backend"
+	"git.cadurx.com/pfdns/resolver"
+)
+
+// how long the resolver gets to send its pending table updates
+const drainTimeout = 10 * time.Second
+
+// shutdown stops the resolver, letting it finish its pending table updates,
+// then leaves, flushes or resets the tables as the config's OnExit says
+func shutdown(sup *supervisor, sig os.Signal) {
+	slog.Info("exiting", "sig", sig)
+
+	var cfg resolver.Config
+	if sup.rs != nil {
+		cfg = sup.rs.cfg
+
+		sup.rs.proc.stop()
+		select {
+		case err := <-sup.rs.quit:
+			slog.Info("resolver stopped", "err", err)
+		case <-time.After(drainTimeout):
+			slog.Warn("resolver didn't stop, killing it", "timeout", drainTimeout)
+			sup.rs.proc.kill()
+			<-sup.rs.quit
+		}
+		sup.rs.drainEvents(drainTimeout)
+		drainHooks(drainTimeout)
+	} else {
+		var err error
+		cfg, err = readConfig()
+		if err != nil {
+			slog.Error("can't read config, leaving tables", "err", err)
+			os.Exit(0)
+		}
+	}
+
+	exit := map[string]backend.Why{"": {Reason: reasonExit}}
+	switch cfg.OnExit {
+	case resolver.OnExitFlush:
+		for _, table := range exitTables(cfg) {
+			exitUpdate(backend.Update{Table: table, Flush: true}, exit)
+		}
+	case resolver.OnExitStatic:
+		for _, table := range exitTables(cfg) {
+			u := backend.Update{Table: table, Flush: true, Add: cfg.SafeTables[table]}
+			if len(u.Add) > 0 {
+				slog.Info("restoring safe ips", "table", table, "ips", u.Add)
+				for _, ip := range u.Add {
+					exit[ip] = backend.Why{Reason: reasonExit}
+				}
+			}
+			exitUpdate(u, exit)
+		}
+	default:
+		slog.Info("leaving tables as they are")
+	}
+
+	os.Exit(0)
+}
+
+// applies u, auditing what made it. the backend logs its own errors
+func exitUpdate(u backend.Update, why map[string]backend.Why) {
+	_ = u.Apply(fw, func(op string, ips []string) {
+		auditLog(op, u.Table, ips, why)
+	})
+}
+
+// every table we manage or have a safe set for
+func exitTables(cfg resolver.Config) []string {
+	seen := make(map[string]bool)
+	var tables []string
+	for _, m := range []map[string][]string{cfg.Tables, cfg.SafeTables} {
+		for table := range m {
+			if !seen[table] {
+				seen[table] = true
+				tables = append(tables, table)
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"git.cadurx.com/pfdns/logging"
+	"git.cadurx.com/pfdns/pfdns"
+)
+
+var single = flag.Bool("single", false, "run the resolver in this process, without a subprocess, chroot or privilege drop")
+
+// the resolver as goroutines of ours, with -single
+type inProcess struct {
+	m    *pfdns.Manager
+	quit chan error
+}
+
+// stop drains the resolver, without holding up shutdown's timeout
+func (p inProcess) stop() {
+	go p.m.Close()
+}
+
+// kill drops the resolver's pending updates, the next one flushes the
+// tables anyway
+func (p inProcess) kill() {
+	p.m.Kill()
+	select {
+	case p.quit <- fmt.Errorf("resolver killed"):
+	default:
+	}
+}
+
+// startInProcess runs the resolver in our process, talking to it through
+// the same Manager as the subprocess
+func startInProcess() *resolverState {
+	resolv, err := os.Open(*resolvConf)
+	if err != nil {
+		logging.Fatal("can't open resolv.conf", "err", err)
+	}
+	defer resolv.Close()
+	conf, err := os.Open(*cfgPath)
+	if err != nil {
+		logging.Fatal("can't open config", "err", err)
+	}
+	defer conf.Close()
+
+	// our copy to diff against on reload
+	cfg, _ := readConfig()
+	// the resolver sets this itself in its subprocess
+	if cfg.Verbose > 0 {
+		logging.Level.Set(slog.LevelDebug)
+	}
+	slog.Debug("config", "cfg", fmt.Sprintf("%+v", cfg))
+	setHooks(cfg.Hooks)
+	setKillStates(cfg.TableOptions)
+
+	m := pfdns.New(fw)
+	stopEvents, eventsDone := subscribe(m)
+
+	quit := make(chan error, 1)
+	err = m.Start(pfdns.Options{Config: conf, ResolvConf: resolv})
+	if err != nil {
+		// dies in init, like the subprocess would
+		quit <- err
+	} else {
+		go func() {
+			<-m.Done()
+			select {
+			case quit <- fmt.Errorf("resolver stopped"):
+			default:
+			}
+		}()
+	}
+
+	return &resolverState{
+		quit: quit,
+		proc: inProcess{m, quit},
+		m:    m,
+		cfg:  cfg,
+
+		stopEvents: stopEvents,
+		eventsDone: eventsDone,
+
+		started: time.Now(),
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"git.cadurx.com/pfdns/backend"
+	"git.cadurx.com/pfdns/resolver"
+)
+
+// how many deletes may wait for their states to be killed
+const stateQueueSize = 1000
+
+// the tables' KillStates, set from the config the resolver runs. a change
+// restarts the resolver
+var killStates struct {
+	mu     sync.Mutex
+	tables map[string]string
+	// deletes waiting for runStates, pfctl is slow and the resolver's
+	// events can't wait for it
+	q chan stateKill
+}
+
+// ips deleted from a table, with the table's KillStates
+type stateKill struct {
+	table string
+	ips   []string
+	mode  string
+}
+
+func setKillStates(opts map[string]resolver.TableOptions) {
+	killStates.mu.Lock()
+	defer killStates.mu.Unlock()
+
+	if killStates.q == nil {
+		killStates.q = make(chan stateKill, stateQueueSize)
+		go runStates(killStates.q)
+	}
+
+	killStates.tables = make(map[string]string)
+	for table, o := range opts {
+		killStates.tables[table] = o.KillStates
+	}
+}
+
+// killTableStates queues killing, or reporting, the pf states from and to
+// ips deleted from table. never blocks, drops them if the queue is full
+func killTableStates(table string, ips []string) {
+	killStates.mu.Lock()
+	defer killStates.mu.Unlock()
+
+	mode := killStates.tables[table]
+	if mode != resolver.KillStatesKill && mode != resolver.KillStatesReport {
+		return
+	}
+
+	select {
+	case killStates.q <- stateKill{table: table, ips: ips, mode: mode}:
+	default:
+		slog.Warn("state queue full, not killing states", "table", table, "ips", ips)
+	}
+}
+
+func runStates(q chan stateKill) {
+	for k := range q {
+		k.run()
+	}
+}
+
+// run kills or reports k's states. failures are only logged, the ips are
+// out of the table already
+func (k stateKill) run() {
+	table, ips := k.table, k.ips
+
+	switch k.mode {
+	case resolver.KillStatesKill:
+		if *dry {
+			// a dry run reports what it would kill
+			reportStates(table, ips)
+			return
+		}
+		for _, ip := range ips {
+			killIPStates(table, ip)
+		}
+
+	case resolver.KillStatesReport:
+		// listing states changes nothing, a dry run reports them too
+		reportStates(table, ips)
+	}
+}
+
+func killIPStates(table string, ip string) {
+	all := "0.0.0.0/0"
+	if strings.Contains(ip, ":") {
+		all = "::/0"
+	}
+
+	// states from ip, then states to it
+	for _, cargs := range [][]string{{"-k", ip}, {"-k", all, "-k", ip}} {
+		out, err := backend.Pfctl(cargs...)
+		if err != nil {
+			slog.Error("can't kill states", "table", table, "ip", ip, "err", err)
+			return
+		}
+		slog.Info("killed states", "table", table, "ip", ip, "out", string(out))
+	}
+}
+
+// reportStates logs the states that killIPStates would kill
+func reportStates(table string, ips []string) {
+	out, err := backend.Pfctl("-q", "-s", "states")
+	if err != nil {
+		slog.Error("can't list states", "table", table, "err", err)
+		return
+	}
+
+	want := make(map[string]bool)
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			want[parsed.String()] = true
+		}
+	}
+
+	found := make(map[string][]string)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		seen := make(map[string]bool)
+		for _, f := range strings.Fields(line) {
+			ip := stateAddr(f)
+			if want[ip] && !seen[ip] {
+				seen[ip] = true
+				found[ip] = append(found[ip], strings.Join(strings.Fields(line), " "))
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		states := found[ip]
+		slog.Info("would kill states", "table", table, "ip", ip, "count", len(states))
+		for _, st := range states {
+			slog.Info("would kill state", "table", table, "ip", ip, "state", st)
+		}
+	}
+}
+
+// stateAddr returns the address of an address field of pfctl -s states,
+// 10.0.0.1:443, 2001:db8::1[443] or either in parentheses when translated.
+// "" if f is something else
+func stateAddr(f string) string {
+	f = strings.Trim(f, "()")
+	if i := strings.IndexByte(f, '['); i >= 0 {
+		f = f[:i]
+	} else if strings.Count(f, ":") == 1 {
+		f = f[:strings.IndexByte(f, ':')]
+	}
+
+	ip := net.ParseIP(f)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
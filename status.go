@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+
+	"git.cadurx.com/pfdns/resolver"
+)
+
+var statusPath = flag.String("status", "", "write status json here on SIGUSR1")
+
+// daemonStatus is what we log and write to statusPath
+type daemonStatus struct {
+	Supervisor supervisorStatus
+	// missing if the resolver is down
+	Resolver *resolver.Status `json:",omitempty"`
+}
+
+// ask the resolver for its status, log it and write it to statusPath
+func requestStatus(sup *supervisor) {
+	st := daemonStatus{Supervisor: sup.status()}
+	rs := sup.rs
+
+	// don't block the main loop on the resolver
+	go func() {
+		if rs != nil {
+			rst, err := rs.m.Status()
+			if err != nil {
+				slog.Error("status request failed", "err", err)
+			} else {
+				st.Resolver = &rst
+			}
+		}
+
+		blob, err := json.Marshal(st)
+		if err != nil {
+			slog.Error("status", "err", err)
+			return
+		}
+
+		slog.Info("status", "status", json.RawMessage(blob))
+
+		if len(*statusPath) > 0 {
+			err := ioutil.WriteFile(*statusPath, append(blob, '\n'), 0644)
+			if err != nil {
+				slog.Error("status", "path", *statusPath, "err", err)
+			}
+		}
+	}()
+}
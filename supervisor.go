@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"git.cadurx.com/pfdns/logging"
+)
+
+// restart backoff and crash loop detection for the resolver
+const (
+	restartMin = 1 * time.Second
+	restartMax = 5 * time.Minute
+
+	// this many crashes within crashWindow and we stop restarting until the
+	// config is reloaded, leaving the tables as they are
+	crashLoop   = 5
+	crashWindow = 10 * time.Minute
+
+	// exit reasons kept for status
+	keepExits = 10
+)
+
+// supervisor keeps the resolver subprocess running
+type supervisor struct {
+	// nil while the resolver is down
+	rs *resolverState
+
+	// we killed it on purpose, restart without counting a crash
+	restarting bool
+
+	// a resolver came up once, we only restart it then
+	upOnce bool
+
+	crashes   []time.Time
+	exits     []exitRecord
+	restarts  uint64
+	crashLoop bool
+
+	restartAt time.Time
+	restartC  <-chan time.Time
+}
+
+type exitRecord struct {
+	Time   time.Time
+	Reason string
+	Uptime string
+}
+
+// supervisorStatus is added to the resolvers status
+type supervisorStatus struct {
+	Running   bool
+	Restarts  uint64
+	CrashLoop bool
+	RestartAt time.Time
+	// most recent last
+	Exits []exitRecord
+}
+
+func (s *supervisor) start() {
+	s.rs = startResolver()
+	s.restarting = false
+	s.restartC = nil
+	s.restartAt = time.Time{}
+}
+
+// started is true once a resolver came up, it parsed the config
+func (s *supervisor) started() bool {
+	if s.rs != nil && s.rs.m.Started() {
+		s.upOnce = true
+	}
+	return s.upOnce
+}
+
+// quit is closed when the resolver dies, nil while it's down
+func (s *supervisor) quit() chan error {
+	if s.rs == nil {
+		return nil
+	}
+	return s.rs.quit
+}
+
+// died decides when, and if, to restart the resolver
+func (s *supervisor) died(err error) {
+	now := time.Now()
+	uptime := now.Sub(s.rs.started)
+
+	// the resolver sends a startup message once it parsed the config. if it
+	// died before, we assume it never will and make that fatal
+	started := s.started()
+	s.rs = nil
+	if !started {
+		logging.Fatal("resolver died in init", "err", err)
+	}
+
+	s.restarts++
+	s.exits = append(s.exits, exitRecord{Time: now, Reason: err.Error(), Uptime: uptime.Round(time.Second).String()})
+	if len(s.exits) > keepExits {
+		s.exits = s.exits[len(s.exits)-keepExits:]
+	}
+
+	if s.restarting {
+		slog.Info("resolver restarting", "err", err)
+		s.start()
+		return
+	}
+
+	// only count recent crashes
+	var recent []time.Time
+	for _, t := range s.crashes {
+		if now.Sub(t) < crashWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.crashes = append(recent, now)
+
+	if len(s.crashes) >= crashLoop {
+		slog.Error("resolver died, not restarting until reload", "err", err, "crashes", len(s.crashes), "window", crashWindow)
+		s.crashLoop = true
+		return
+	}
+
+	delay := restartMin
+	for n := 1; n < len(s.crashes) && delay < restartMax; n++ {
+		delay *= 2
+	}
+	if delay > restartMax {
+		delay = restartMax
+	}
+
+	slog.Warn("resolver died, restarting", "err", err, "in", delay)
+	s.restartAt = now.Add(delay)
+	s.restartC = time.After(delay)
+}
+
+// restart the resolver now, not counted as a crash
+func (s *supervisor) restart(reason string) {
+	slog.Info("restarting resolver", "reason", reason)
+
+	if s.rs == nil {
+		s.clearCrashes()
+		s.start()
+		return
+	}
+
+	// will respawn when we get <-s.quit()
+	s.restarting = true
+	s.rs.proc.kill()
+}
+
+// reload sends config changes to the resolver, restarting it if needed. a
+// reload gets a crash looping resolver going again
+func (s *supervisor) reload() {
+	if s.rs == nil {
+		if s.crashLoop {
+			s.restart("reload after crash loop")
+		}
+		// otherwise it picks up the new config when it restarts
+		return
+	}
+
+	if reload(s.rs) {
+		s.restart("config options changed")
+	}
+}
+
+func (s *supervisor) clearCrashes() {
+	s.crashes = nil
+	s.crashLoop = false
+}
+
+func (s *supervisor) status() supervisorStatus {
+	return supervisorStatus{
+		Running:   s.rs != nil,
+		Restarts:  s.restarts,
+		CrashLoop: s.crashLoop,
+		RestartAt: s.restartAt,
+		Exits:     append([]exitRecord{}, s.exits...),
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"git.cadurx.com/pfdns/logging"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// wait for things to settle before looking at a changed file, editors and
+// config management write, rename and chmod in quick succession
+const watchDebounce = 500 * time.Millisecond
+
+// check at the latest this long after the first event, in a directory that
+// never settles
+const watchMaxDelay = 5 * time.Second
+
+// fileWatcher sends a files path on Changed when its contents change, no
+// matter if it was written in place, replaced by a rename, or is a symlink
+// that was pointed somewhere else. writes that don't change the contents are
+// ignored
+type fileWatcher struct {
+	Changed chan string
+
+	w     *fsnotify.Watcher
+	files []*watchedFile
+	dirs  map[string]bool
+}
+
+type watchedFile struct {
+	path string
+	hash [sha256.Size]byte
+	// saw an event in a watched dir since the last check
+	dirty bool
+}
+
+func watchFiles(paths ...string) *fileWatcher {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logging.Fatal("can't watch files", "err", err)
+	}
+
+	fw := &fileWatcher{
+		Changed: make(chan string),
+		w:       w,
+		dirs:    make(map[string]bool),
+	}
+
+	for _, path := range paths {
+		f := &watchedFile{path: path}
+		f.hash, _ = hashFile(path)
+		fw.files = append(fw.files, f)
+		fw.watchDirs(f)
+	}
+
+	go fw.run()
+	return fw
+}
+
+// watchDirs we have to watch on the dir, editors rename/remove the old file.
+// if the file is a symlink we watch the targets dir as well
+func (fw *fileWatcher) watchDirs(f *watchedFile) {
+	dirs := []string{filepath.Dir(f.path)}
+	if target, err := filepath.EvalSymlinks(f.path); err == nil && target != f.path {
+		dirs = append(dirs, filepath.Dir(target))
+	}
+
+	for _, dir := range dirs {
+		if fw.dirs[dir] {
+			continue
+		}
+		err := fw.w.Add(dir)
+		if err != nil {
+			slog.Error("can't watch", "path", f.path, "dir", dir, "err", err)
+			continue
+		}
+		fw.dirs[dir] = true
+	}
+}
+
+func (fw *fileWatcher) run() {
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	// first event since the last check, zero if none
+	var first time.Time
+
+	for {
+		select {
+		case _, ok := <-fw.w.Events:
+			if !ok {
+				return
+			}
+			// any event in a watched dir may change a file, swapping a
+			// symlink in its path (k8s' ..data) or removing the directory
+			// it pointed to doesn't name it. check hashes them all
+			for _, f := range fw.files {
+				f.dirty = true
+			}
+
+			now := time.Now()
+			if first.IsZero() {
+				first = now
+			}
+			if wait := first.Add(watchMaxDelay).Sub(now); wait < watchDebounce {
+				debounce.Reset(wait)
+			} else {
+				debounce.Reset(watchDebounce)
+			}
+		case err, ok := <-fw.w.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("watcher", "err", err)
+		case <-debounce.C:
+			first = time.Time{}
+			fw.check()
+		}
+	}
+}
+
+// check the files we saw events for, sends the ones whose contents changed
+func (fw *fileWatcher) check() {
+	for _, f := range fw.files {
+		if !f.dirty {
+			continue
+		}
+		f.dirty = false
+
+		// a symlink may point somewhere new
+		fw.watchDirs(f)
+
+		hash, err := hashFile(f.path)
+		if err != nil {
+			// removed, wait for it to come back
+			slog.Warn("can't read", "path", f.path, "err", err)
+			continue
+		}
+		if hash == f.hash {
+			continue
+		}
+
+		f.hash = hash
+		fw.Changed <- f.path
+	}
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(blob), nil
+}